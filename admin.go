@@ -0,0 +1,369 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+type apiArea struct {
+    Kind   string  `json:"kind"`
+    Name   string  `json:"name,omitempty"`
+    Lat    float64 `json:"lat,omitempty"`
+    Lng    float64 `json:"lng,omitempty"`
+    Radius float64 `json:"radius,omitempty"`
+}
+
+type apiChat struct {
+    ID          string   `json:"id"`
+    All         bool     `json:"all"`
+    Subscribes  []string `json:"subscribes"`
+    Area        *apiArea `json:"area"`
+    Quarantined bool     `json:"quarantined"`
+}
+
+// Results Of addSubscriber And removeSubscriber, Indexed By Their Codes
+var subscribeResults = []string{"subscribed", "subscribed_all", "already_all"}
+var unsubscribeResults = []string{"unsubscribed", "unsubscribed_all", "removed_all"}
+
+func adminRoutes(router *mux.Router) {
+    admin := router.PathPrefix("/api/v1/admin").Subrouter()
+    admin.Use(func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if !authorized(r, scopeAdmin) {
+                writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    })
+    admin.HandleFunc("/chats", adminChatsHandler).Methods("GET")
+    admin.HandleFunc("/chats/{id}", adminChatHandler).Methods("GET")
+    admin.HandleFunc("/chats/{id}", adminRemoveChatHandler).Methods("DELETE")
+    admin.HandleFunc("/chats/{id}/subscriptions", adminSubscribeHandler).Methods("POST")
+    admin.HandleFunc("/chats/{id}/subscriptions", adminUnsubscribeHandler).Methods("DELETE")
+    admin.HandleFunc("/keys", adminKeysHandler).Methods("GET")
+    admin.HandleFunc("/keys", adminCreateKeyHandler).Methods("POST")
+    admin.HandleFunc("/keys/{id:[0-9]+}", adminRevokeKeyHandler).Methods("DELETE")
+    admin.HandleFunc("/webhooks", adminWebhooksHandler).Methods("GET")
+    admin.HandleFunc("/webhooks", adminCreateWebhookHandler).Methods("POST")
+    admin.HandleFunc("/webhooks/{id:[0-9]+}", adminRemoveWebhookHandler).Methods("DELETE")
+    admin.HandleFunc("/webhooks/{id:[0-9]+}/deliveries", adminWebhookDeliveriesHandler).Methods("GET")
+}
+
+func adminChatsHandler(w http.ResponseWriter, r *http.Request) {
+    ids, err := retriveChats()
+    if err != nil {
+        writeServerError(w, "list chats", err)
+        return
+    }
+    chats := []apiChat{}
+    for _, id := range ids {
+        chat, err := retriveChat(id)
+        if err != nil {
+            writeServerError(w, "list chats", err)
+            return
+        }
+        chats = append(chats, chat)
+    }
+    writeJSON(w, http.StatusOK, map[string][]apiChat{"chats": chats})
+}
+
+func adminChatHandler(w http.ResponseWriter, r *http.Request) {
+    id, ok := adminChatID(w, r)
+    if !ok {
+        return
+    }
+    chat, err := retriveChat(id)
+    if err != nil {
+        writeServerError(w, "get chat "+id, err)
+        return
+    }
+    writeJSON(w, http.StatusOK, chat)
+}
+
+func adminRemoveChatHandler(w http.ResponseWriter, r *http.Request) {
+    id, ok := adminChatID(w, r)
+    if !ok {
+        return
+    }
+    if err := removeChat(id); err != nil {
+        writeServerError(w, "remove chat "+id, err)
+        return
+    }
+    log.Println("Admin API removed chat " + id + ".")
+    w.WriteHeader(http.StatusNoContent)
+}
+
+func adminSubscribeHandler(w http.ResponseWriter, r *http.Request) {
+    id, ok := adminChatID(w, r)
+    if !ok {
+        return
+    }
+    var body struct {
+        Defects []string `json:"defects"`
+        Area    string   `json:"area"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format unaccepted"})
+        return
+    }
+
+    // Area uses the same format as the sub command, e.g. near 25.0330,121.5654 500m
+    _, area, err := areaArguments(strings.Fields(body.Area))
+    if err != nil || (body.Area != "" && area == nil) {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format unaccepted"})
+        return
+    }
+    if area != nil {
+        if current, err := checkGeofence(id, area); err == errAreaConflict {
+            writeJSON(w, http.StatusConflict, map[string]string{"error": "chat already subscribes area " + current.describe()})
+            return
+        } else if err != nil {
+            writeServerError(w, "subscribe "+id, err)
+            return
+        }
+    }
+    result, err := addSubscriber(id, body.Defects)
+    if err == nil && area != nil && result < len(subscribeResults) {
+        err = setGeofence(id, area)
+    }
+    if err != nil {
+        writeServerError(w, "subscribe "+id, err)
+        return
+    }
+    if result >= len(subscribeResults) {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format unaccepted"})
+        return
+    }
+
+    log.Println("Admin API subscribed " + id + " to " + strings.Join(body.Defects, " ") + ".")
+    adminChatResult(w, id, subscribeResults[result])
+}
+
+func adminUnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+    id, ok := adminChatID(w, r)
+    if !ok {
+        return
+    }
+    // Same as the unsub command, defects=all removes everything, none removes the all subscription
+    var arguments []string
+    if defects := r.URL.Query().Get("defects"); defects != "" {
+        arguments = strings.Split(defects, ".")
+    }
+    if contains(arguments, "area") {
+        if len(arguments) != 1 {
+            writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format unaccepted"})
+            return
+        }
+        if err := removeGeofence(id); err != nil {
+            writeServerError(w, "unsubscribe "+id+" from area", err)
+            return
+        }
+        log.Println("Admin API unsubscribed " + id + " from area.")
+        adminChatResult(w, id, "unsubscribed_area")
+        return
+    }
+
+    result, err := removeSubscriber(id, arguments)
+    if err != nil {
+        writeServerError(w, "unsubscribe "+id, err)
+        return
+    }
+    if result >= len(unsubscribeResults) {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format unaccepted"})
+        return
+    }
+
+    log.Println("Admin API unsubscribed " + id + " from " + strings.Join(arguments, " ") + ".")
+    adminChatResult(w, id, unsubscribeResults[result])
+}
+
+func adminChatResult(w http.ResponseWriter, id string, result string) {
+    chat, err := retriveChat(id)
+    if err != nil {
+        writeServerError(w, "get chat "+id, err)
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]interface{}{"result": result, "chat": chat})
+}
+
+func adminKeysHandler(w http.ResponseWriter, r *http.Request) {
+    keys, err := retriveAPIKeys()
+    if err != nil {
+        writeServerError(w, "list keys", err)
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]interface{}{"keys": keys})
+}
+
+func adminCreateKeyHandler(w http.ResponseWriter, r *http.Request) {
+    var body struct {
+        Name    string   `json:"name"`
+        Scopes  []string `json:"scopes"`
+        Chats   []string `json:"chats"`
+        Expires string   `json:"expires"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Name == "" || len(body.Scopes) == 0 {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format unaccepted"})
+        return
+    }
+    if len(body.Chats) == 0 {
+        body.Chats = []string{"*"}
+    }
+    var ttl time.Duration
+    if body.Expires != "" {
+        var err error
+        if ttl, err = time.ParseDuration(body.Expires); err != nil || ttl <= 0 {
+            writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format unaccepted"})
+            return
+        }
+    }
+
+    if err := validAPIKey(body.Scopes, body.Chats); err != nil {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+        return
+    }
+    secret, err := createAPIKey(body.Name, body.Scopes, body.Chats, ttl)
+    if err != nil {
+        writeServerError(w, "create key", err)
+        return
+    }
+    log.Println("Admin API created key " + body.Name + ".")
+    writeJSON(w, http.StatusCreated, map[string]string{"key": secret})
+}
+
+func adminRevokeKeyHandler(w http.ResponseWriter, r *http.Request) {
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+    revoked, err := revokeAPIKey(id)
+    if err != nil {
+        writeServerError(w, "revoke key", err)
+        return
+    }
+    if !revoked {
+        writeJSON(w, http.StatusNotFound, map[string]string{"error": "no active key"})
+        return
+    }
+    log.Println(fmt.Sprintf("Admin API revoked key %d.", id))
+    w.WriteHeader(http.StatusNoContent)
+}
+
+func adminWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+    webhooks, err := retriveWebhookList()
+    if err != nil {
+        writeServerError(w, "list webhooks", err)
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]interface{}{"webhooks": webhooks})
+}
+
+func adminCreateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+    var body struct {
+        URL     string   `json:"url"`
+        Secret  string   `json:"secret"`
+        Defects []string `json:"defects"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format unaccepted"})
+        return
+    }
+
+    if err := validWebhook(body.URL, body.Secret, body.Defects); err != nil {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+        return
+    }
+    id, err := createWebhook(body.URL, body.Secret, body.Defects)
+    if err != nil {
+        writeServerError(w, "register webhook", err)
+        return
+    }
+    log.Println(fmt.Sprintf("Admin API registered webhook %d to %s.", id, body.URL))
+    response := map[string]interface{}{"id": id}
+    if !watcherEnabled() {
+        response["warning"] = eventDefectNew + " is only sent while WatchInterval is set, this webhook gets digest only"
+    }
+    writeJSON(w, http.StatusCreated, response)
+}
+
+func adminRemoveWebhookHandler(w http.ResponseWriter, r *http.Request) {
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+    removed, err := removeWebhook(id)
+    if err != nil {
+        writeServerError(w, "remove webhook", err)
+        return
+    }
+    if !removed {
+        writeJSON(w, http.StatusNotFound, map[string]string{"error": "no webhook"})
+        return
+    }
+    log.Println(fmt.Sprintf("Admin API removed webhook %d.", id))
+    w.WriteHeader(http.StatusNoContent)
+}
+
+func adminWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+    limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+    if err != nil || limit < 1 || limit > 1000 {
+        limit = 100
+    }
+    deliveries, err := retriveWebhookDeliveries(id, limit)
+    if err != nil {
+        writeServerError(w, "list webhook deliveries", err)
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]interface{}{"deliveries": deliveries})
+}
+
+func adminChatID(w http.ResponseWriter, r *http.Request) (string, bool) {
+    id := mux.Vars(r)["id"]
+    if !validTarget(id) {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "id unaccepted"})
+        return id, false
+    }
+    return id, true
+}
+
+func retriveChats() ([]string, error) {
+    rows, err := db.Query("select id from subscriber union select id from geofence union select id from schedule union select id from delivery order by id")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    ids := []string{}
+    for rows.Next() {
+        var id string
+        if err = rows.Scan(&id); err != nil {
+            return nil, err
+        }
+        ids = append(ids, id)
+    }
+    return ids, rows.Err()
+}
+
+func retriveChat(id string) (apiChat, error) {
+    chat := apiChat{ID: id}
+    var err error
+    if chat.Quarantined, err = isQuarantined(id); err != nil {
+        return chat, err
+    }
+    if chat.All, chat.Subscribes, err = retriveSubscribe(id); err != nil {
+        return chat, err
+    }
+
+    area, err := retriveGeofence(id)
+    if area != nil {
+        chat.Area = &apiArea{Kind: area.kind, Name: area.name}
+        if area.kind == "near" {
+            chat.Area.Lat, chat.Area.Lng, chat.Area.Radius = area.lat, area.lng, area.radius
+        }
+    }
+    return chat, err
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Defects In One Page Of The API, Unless page_size Says Otherwise
+const (
+    apiPageSize    = 50
+    maxAPIPageSize = 500
+)
+
+type apiPeriod struct {
+    From string `json:"from"`
+    To   string `json:"to"`
+}
+
+type apiDefect struct {
+    SeqID        string   `json:"seq_id"`
+    MarkID       string   `json:"markid"`
+    Name         string   `json:"name"`
+    Date         string   `json:"date"`
+    Time         string   `json:"time"`
+    Lat          *float64 `json:"lat"`
+    Lng          *float64 `json:"lng"`
+    Address      string   `json:"address"`
+    PhotoPreview string   `json:"photo_preview"`
+    Photo        string   `json:"photo"`
+}
+
+type apiDefectNum struct {
+    MarkID string `json:"markid"`
+    Name   string `json:"name"`
+    Count  int    `json:"count"`
+}
+
+func apiDefectsHandler(w http.ResponseWriter, r *http.Request) {
+    query, ok := apiQuery(w, r)
+    if !ok {
+        return
+    }
+    size, err := apiPageSizeOf(r.URL.Query())
+    if err != nil {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format unaccepted"})
+        return
+    }
+
+    defectDetails, err := retriveDefectPage("", query, size)
+    if err != nil {
+        writeServerError(w, "list defects", err)
+        return
+    }
+    hasNext := len(defectDetails) > size
+    if hasNext {
+        defectDetails = defectDetails[:size]
+    }
+
+    response := struct {
+        Period     apiPeriod   `json:"period"`
+        Page       int         `json:"page"`
+        PageSize   int         `json:"page_size"`
+        HasNext    bool        `json:"has_next"`
+        NextCursor string      `json:"next_cursor,omitempty"`
+        Defects    []apiDefect `json:"defects"`
+    }{Period: formatAPIPeriod(query), Page: query.page, PageSize: size, HasNext: hasNext, Defects: []apiDefect{}}
+    for _, defectDetail := range defectDetails {
+        response.Defects = append(response.Defects, formatAPIDefect(defectDetail))
+    }
+    if hasNext {
+        last := defectDetails[len(defectDetails)-1]
+        response.NextCursor = last.markdate + " " + last.marktime + "_" + last.seq_id
+    }
+
+    writeJSON(w, http.StatusOK, response)
+}
+
+func apiSummaryHandler(w http.ResponseWriter, r *http.Request) {
+    query, ok := apiQuery(w, r)
+    if !ok {
+        return
+    }
+
+    defects, err := retriveDefectNum("", query)
+    if err != nil {
+        writeServerError(w, "summarize defects", err)
+        return
+    }
+
+    response := struct {
+        Period  apiPeriod      `json:"period"`
+        Total   int            `json:"total"`
+        Defects []apiDefectNum `json:"defects"`
+    }{Period: formatAPIPeriod(query), Defects: []apiDefectNum{}}
+    for _, defect := range defects {
+        response.Total += defect.num
+        response.Defects = append(response.Defects, apiDefectNum{MarkID: defect.markid, Name: defectName(defect.markid), Count: defect.num})
+    }
+
+    writeJSON(w, http.StatusOK, response)
+}
+
+func apiQuery(w http.ResponseWriter, r *http.Request) (DefectQuery, bool) {
+    /*
+       DefectQuery : query from the parameters
+       bool : false if a response is already written
+    */
+
+    if !authorized(r, scopeRead) {
+        writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+        return DefectQuery{}, false
+    }
+
+    values := r.URL.Query()
+    query, err := exportQuery(values)
+    if err == nil {
+        err = apiPaging(values, &query)
+    }
+    if err == nil && values.Get("bbox") != "" {
+        if query.area != nil {
+            err = errors.New("area and bbox are exclusive")
+        } else {
+            query.area, err = parseBBox(values.Get("bbox"))
+        }
+    }
+    if err != nil {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format unaccepted"})
+        return query, false
+    }
+    return query, true
+}
+
+func apiPaging(values url.Values, query *DefectQuery) error {
+    if page := values.Get("page"); page != "" {
+        var err error
+        if query.page, err = strconv.Atoi(page); err != nil || query.page < 1 {
+            return errors.New("invalid page")
+        }
+    }
+    if query.cursor = values.Get("cursor"); query.cursor != "" && !matchString(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}_\d+$`, query.cursor) {
+        return errors.New("invalid cursor")
+    }
+    return nil
+}
+
+func apiPageSizeOf(values url.Values) (int, error) {
+    if values.Get("page_size") == "" {
+        return apiPageSize, nil
+    }
+    size, err := strconv.Atoi(values.Get("page_size"))
+    if err != nil || size < 1 || size > maxAPIPageSize {
+        return 0, fmt.Errorf("page_size must be 1 to %d", maxAPIPageSize)
+    }
+    return size, nil
+}
+
+func parseBBox(s string) (*Geofence, error) {
+    // minLat,minLng,maxLat,maxLng
+    parts := strings.Split(s, ",")
+    if len(parts) != 4 {
+        return nil, errors.New("invalid bbox")
+    }
+    var bounds [4]float64
+    for i, part := range parts {
+        var err error
+        if bounds[i], err = strconv.ParseFloat(part, 64); err != nil {
+            return nil, errors.New("invalid bbox")
+        }
+    }
+    minLat, minLng, maxLat, maxLng := bounds[0], bounds[1], bounds[2], bounds[3]
+    if minLat >= maxLat || minLng >= maxLng || minLat < -90 || maxLat > 90 || minLng < -180 || maxLng > 180 {
+        return nil, errors.New("invalid bbox")
+    }
+    ring := [][2]float64{{minLng, minLat}, {maxLng, minLat}, {maxLng, maxLat}, {minLng, maxLat}, {minLng, minLat}}
+    return &Geofence{kind: "polygon", name: "bbox " + s, polygons: [][][][2]float64{{ring}}}, nil
+}
+
+func formatAPIDefect(defectDetail DefectDetail) apiDefect {
+    defect := apiDefect{SeqID: defectDetail.seq_id, MarkID: defectDetail.markid, Name: defectName(defectDetail.markid), Date: defectDetail.markdate, Time: defectDetail.marktime, Address: defectDetail.address}
+    if lat, lng, located := detailLocation(defectDetail); located {
+        defect.Lat, defect.Lng = &lat, &lng
+    }
+    defect.PhotoPreview, defect.Photo = photoURIs(defectDetail)
+    return defect
+}
+
+func formatAPIPeriod(query DefectQuery) apiPeriod {
+    to, from := query.to, query.from
+    if query.window != 0 {
+        to = time.Now().In(remoteZone)
+        from = to.Add(-query.window)
+    }
+    return apiPeriod{From: from.Format(time.RFC3339), To: to.Format(time.RFC3339)}
+}
+
+func writeServerError(w http.ResponseWriter, action string, err error) {
+    log.Println(fmt.Sprintf(`API failed to %s : "%s".`, action, err))
+    if errors.Is(err, errDatabaseUnavailable) {
+        writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "database unavailable"})
+        return
+    }
+    writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+}
+
+func writeJSON(w http.ResponseWriter, status int, response interface{}) {
+    w.Header().Set("Content-Type", "application/json; charset=utf-8")
+    w.WriteHeader(status)
+    if err := json.NewEncoder(w).Encode(response); err != nil {
+        log.Println(err)
+    }
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/hex"
+    "errors"
+    "flag"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Scopes Of HTTP API Keys
+const (
+    scopeRead    = "read"
+    scopeTrigger = "trigger"
+    scopeAdmin   = "admin"
+)
+
+// Prefix Of Generated API Keys, So Leaked Ones Are Easy To Grep For
+const apiKeyPrefix = "dlb_"
+
+type APIKey struct {
+    id     int
+    name   string
+    scopes []string
+    chats  []string
+}
+
+func (key APIKey) allows(scope string) bool {
+    return contains(key.scopes, scopeAdmin) || contains(key.scopes, scope)
+}
+
+func (key APIKey) canPush(id string) bool {
+    return contains(key.chats, "*") || contains(key.chats, id)
+}
+
+func hashAPIKey(secret string) string {
+    sum := sha256.Sum256([]byte(secret))
+    return hex.EncodeToString(sum[:])
+}
+
+func requestKey(r *http.Request) (APIKey, bool) {
+    secret := r.Header.Get("X-API-Key")
+    if secret == "" {
+        secret = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    }
+    if !strings.HasPrefix(secret, apiKeyPrefix) {
+        return APIKey{}, false
+    }
+
+    var key APIKey
+    var scopes, chats string
+    err := db.QueryRow("select id, name, scopes, chats from apikey where hash = ? and revoked = 0 and (expires_at is null or expires_at > datetime('now', 'localtime'))", hashAPIKey(secret)).Scan(&key.id, &key.name, &scopes, &chats)
+    if err == sql.ErrNoRows {
+        return key, false
+    } else if err != nil { // Deny rather than guess while the database fails
+        log.Println(fmt.Sprintf(`Checking API key failed : "%s".`, err))
+        return key, false
+    }
+    key.scopes, key.chats = strings.Split(scopes, ","), strings.Split(chats, ",")
+    return key, true
+}
+
+func authorized(r *http.Request, scope string) bool {
+    key, ok := requestKey(r)
+    return ok && key.allows(scope)
+}
+
+func validAPIKey(scopes []string, chats []string) error {
+    for _, scope := range scopes {
+        if scope != scopeRead && scope != scopeTrigger && scope != scopeAdmin {
+            return errors.New("unknown scope " + scope)
+        }
+    }
+    for _, chat := range chats {
+        if chat != "*" && !validTarget(chat) {
+            return errors.New("invalid chat id " + chat)
+        }
+    }
+    return nil
+}
+
+func createAPIKey(name string, scopes []string, chats []string, ttl time.Duration) (string, error) {
+    /*
+       string : the key, only known at this moment since it's stored hashed
+    */
+
+    if err := validAPIKey(scopes, chats); err != nil {
+        return "", err
+    }
+
+    buffer := make([]byte, 24)
+    if _, err := rand.Read(buffer); err != nil {
+        return "", err
+    }
+    secret := apiKeyPrefix + hex.EncodeToString(buffer)
+
+    var expiresAt interface{}
+    if ttl > 0 {
+        expiresAt = time.Now().Add(ttl).Format("2006-01-02 15:04:05")
+    }
+    if _, err := db.Exec("insert into apikey (name, hash, scopes, chats, expires_at, created_at) values (?, ?, ?, ?, ?, datetime('now', 'localtime'))", name, hashAPIKey(secret), strings.Join(scopes, ","), strings.Join(chats, ","), expiresAt); err != nil {
+        return "", err
+    }
+    return secret, nil
+}
+
+func revokeAPIKey(id int) (bool, error) {
+    result, err := db.Exec("update apikey set revoked = 1 where id = ? and revoked = 0", id)
+    if err != nil {
+        return false, err
+    }
+    revoked, _ := result.RowsAffected()
+    return revoked == 1, nil
+}
+
+func retriveAPIKeys() ([]map[string]interface{}, error) {
+    rows, err := db.Query("select id, name, scopes, chats, coalesce(expires_at, ''), created_at, revoked from apikey order by id")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    keys := []map[string]interface{}{}
+    for rows.Next() {
+        var id, revoked int
+        var name, scopes, chats, expiresAt, createdAt string
+        if err = rows.Scan(&id, &name, &scopes, &chats, &expiresAt, &createdAt, &revoked); err != nil {
+            return nil, err
+        }
+        keys = append(keys, map[string]interface{}{"id": id, "name": name, "scopes": strings.Split(scopes, ","), "chats": strings.Split(chats, ","), "expires_at": expiresAt, "created_at": createdAt, "revoked": revoked == 1})
+    }
+    return keys, rows.Err()
+}
+
+func apikeyCommand(arguments []string) int {
+    /*
+       return : exit code
+    */
+
+    usage := `usage:
+  defect-linebot apikey create -name <name> -scopes <read,trigger,admin> [-chats <ids | *>] [-expires <duration>]
+  defect-linebot apikey list
+  defect-linebot apikey revoke <id>`
+    if len(arguments) == 0 {
+        fmt.Fprintln(os.Stderr, usage)
+        return 2
+    }
+
+    switch arguments[0] {
+    case "create":
+        flags := flag.NewFlagSet("create", flag.ContinueOnError)
+        name := flags.String("name", "", "who or what uses the key")
+        scopes := flags.String("scopes", scopeRead, "comma separated scopes")
+        chats := flags.String("chats", "*", "comma separated chat ids the key may push to")
+        expires := flags.String("expires", "", "lifetime of the key, e.g. 720h, never expires if empty")
+        if err := flags.Parse(arguments[1:]); err != nil || *name == "" {
+            fmt.Fprintln(os.Stderr, usage)
+            return 2
+        }
+        var ttl time.Duration
+        if *expires != "" {
+            var err error
+            if ttl, err = time.ParseDuration(*expires); err != nil || ttl <= 0 {
+                fmt.Fprintln(os.Stderr, "invalid expires "+*expires)
+                return 2
+            }
+        }
+        secret, err := createAPIKey(*name, strings.Split(*scopes, ","), strings.Split(*chats, ","), ttl)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        }
+        fmt.Println(secret)
+        fmt.Fprintln(os.Stderr, "Store the key now, it can not be shown again.")
+    case "list":
+        keys, err := retriveAPIKeys()
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        }
+        for _, key := range keys {
+            status := "active"
+            if key["revoked"].(bool) {
+                status = "revoked"
+            }
+            fmt.Printf("%d\t%s\t%s\t%s\texpires %s\t%s\n", key["id"], key["name"], strings.Join(key["scopes"].([]string), ","), strings.Join(key["chats"].([]string), ","), key["expires_at"], status)
+        }
+    case "revoke":
+        if len(arguments) != 2 {
+            fmt.Fprintln(os.Stderr, usage)
+            return 2
+        }
+        id, err := strconv.Atoi(arguments[1])
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "no active key "+arguments[1])
+            return 1
+        }
+        revoked, err := revokeAPIKey(id)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        } else if !revoked {
+            fmt.Fprintln(os.Stderr, "no active key "+arguments[1])
+            return 1
+        }
+        fmt.Println("revoked " + arguments[1])
+    default:
+        fmt.Fprintln(os.Stderr, usage)
+        return 2
+    }
+    return 0
+}
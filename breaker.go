@@ -0,0 +1,170 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+)
+
+// Returned Instead Of Querying While The Remote Database Is Down
+var errDatabaseUnavailable = errors.New("remote database unavailable")
+
+// Consecutive Failures Before The Circuit Opens
+const breakerThreshold = 3
+
+// Delays Between Reconnection Attempts, Doubling From The First Up To The Last
+const (
+    reconnectMinBackoff = time.Second
+    reconnectMaxBackoff = time.Minute
+)
+
+// DefectSource Failing Fast While The Remote Database Is Down, Reconnecting In The Background
+type breakerSource struct {
+    DefectSource
+    lock     sync.Mutex
+    failures int
+    open     bool
+    // Called Once The Remote Database Is Reachable Again
+    reconnected func()
+}
+
+func newBreakerSource(source DefectSource, reconnected func()) *breakerSource {
+    return &breakerSource{DefectSource: source, reconnected: reconnected}
+}
+
+func (breaker *breakerSource) Defects(query DefectQuery, order int, limit int, offset int, each func(DefectDetail) error) error {
+    if breaker.isOpen() {
+        return errDatabaseUnavailable
+    }
+    return breaker.record(breaker.DefectSource.Defects(query, order, limit, offset, each))
+}
+
+func (breaker *breakerSource) Defect(seq string) (DefectDetail, bool, error) {
+    if breaker.isOpen() {
+        return DefectDetail{}, false, errDatabaseUnavailable
+    }
+    defectDetail, ok, err := breaker.DefectSource.Defect(seq)
+    return defectDetail, ok, breaker.record(err)
+}
+
+func (breaker *breakerSource) CountDefects(query DefectQuery) ([]Defect, error) {
+    if breaker.isOpen() {
+        return nil, errDatabaseUnavailable
+    }
+    defects, err := breaker.DefectSource.CountDefects(query)
+    return defects, breaker.record(err)
+}
+
+func (breaker *breakerSource) CountDefectsBy(query DefectQuery, unit string) (map[string]int, error) {
+    if breaker.isOpen() {
+        return nil, errDatabaseUnavailable
+    }
+    counts, err := breaker.DefectSource.CountDefectsBy(query, unit)
+    return counts, breaker.record(err)
+}
+
+func (breaker *breakerSource) LatestSeq(query DefectQuery) (string, error) {
+    if breaker.isOpen() {
+        return "", errDatabaseUnavailable
+    }
+    latest, err := breaker.DefectSource.LatestSeq(query)
+    return latest, breaker.record(err)
+}
+
+func (breaker *breakerSource) Roadmarks() (map[string]string, error) {
+    if breaker.isOpen() {
+        return nil, errDatabaseUnavailable
+    }
+    names, err := breaker.DefectSource.Roadmarks()
+    return names, breaker.record(err)
+}
+
+func (breaker *breakerSource) Ping() error {
+    if breaker.isOpen() {
+        return errDatabaseUnavailable
+    }
+    err := breaker.DefectSource.Ping()
+    if err != nil {
+        breaker.fail(err)
+        return fmt.Errorf("%w : %s", errDatabaseUnavailable, err)
+    }
+    breaker.succeed()
+    return nil
+}
+
+func (breaker *breakerSource) isOpen() bool {
+    breaker.lock.Lock()
+    defer breaker.lock.Unlock()
+    return breaker.open
+}
+
+func (breaker *breakerSource) record(err error) error {
+    /*
+       return : err, marked unavailable if the database can't be reached either
+    */
+
+    if err == nil {
+        breaker.succeed()
+        return nil
+    }
+    // A bad query or a failed callback says nothing about the connection
+    if pingErr := breaker.DefectSource.Ping(); pingErr == nil {
+        return err
+    }
+    breaker.fail(err)
+    return fmt.Errorf("%w : %s", errDatabaseUnavailable, err)
+}
+
+func (breaker *breakerSource) succeed() {
+    breaker.lock.Lock()
+    defer breaker.lock.Unlock()
+    breaker.failures = 0
+}
+
+func (breaker *breakerSource) fail(err error) {
+    breaker.lock.Lock()
+    defer breaker.lock.Unlock()
+    breaker.failures += 1
+    if breaker.open || breaker.failures < breakerThreshold {
+        return
+    }
+    breaker.open = true
+    log.Println(fmt.Sprintf(`Remote database circuit opened after %d failures : "%s".`, breaker.failures, err))
+    go breaker.reconnect()
+}
+
+// Opens The Circuit Right Away, For A Remote Database Already Down At Start
+func (breaker *breakerSource) trip(err error) {
+    breaker.lock.Lock()
+    defer breaker.lock.Unlock()
+    if breaker.open {
+        return
+    }
+    breaker.open = true
+    log.Println(fmt.Sprintf(`Remote database circuit opened : "%s".`, err))
+    go breaker.reconnect()
+}
+
+func (breaker *breakerSource) reconnect() {
+    backoff := reconnectMinBackoff
+    for attempt := 1; ; attempt++ {
+        time.Sleep(backoff)
+        err := breaker.DefectSource.Ping()
+        if err == nil {
+            breaker.lock.Lock()
+            breaker.open, breaker.failures = false, 0
+            breaker.lock.Unlock()
+            log.Println(fmt.Sprintf("Remote database reconnected after %d attempts.", attempt))
+            if breaker.reconnected != nil {
+                breaker.reconnected()
+            }
+            return
+        }
+        if backoff *= 2; backoff > reconnectMaxBackoff {
+            backoff = reconnectMaxBackoff
+        }
+        log.Println(fmt.Sprintf(`Reconnecting remote database failed, retry in %s : "%s".`, backoff, err))
+    }
+}
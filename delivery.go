@@ -0,0 +1,255 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "net/textproto"
+    "os"
+    "strconv"
+    "strings"
+
+    "github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// Reasons Of Failed Deliveries
+const (
+    reasonInvalid     = "invalid"
+    reasonBlocked     = "blocked"
+    reasonNotFound    = "not_found"
+    reasonRateLimited = "rate_limited"
+    reasonUnavailable = "unavailable"
+    reasonBadRequest  = "bad_request" // The message is at fault, not the chat
+    reasonForbidden   = "forbidden"   // The channel lacks permission, for every chat alike
+)
+
+// Default Permanent Failures Before A Chat Is Quarantined
+const defaultQuarantineThreshold = 3
+
+func pushMessage(id string, messages ...linebot.SendingMessage) error {
+    _, err := bot.PushMessage(id, messages...).Do()
+    recordDelivery(id, err)
+    return err
+}
+
+func classifyPushError(err error) (string, bool) {
+    /*
+       string : reason of the failure
+       bool : true if the chat will never be reachable again
+    */
+
+    // Only failures pointing at the recipient count as permanent, the others may hit every chat alike
+    var apiError *linebot.APIError
+    var telegramError *TelegramError
+    var smtpError *textproto.Error
+    switch {
+    case errors.As(err, &apiError):
+        return classifyLINEError(apiError)
+    case errors.As(err, &telegramError):
+        return classifyTelegramError(telegramError)
+    case errors.As(err, &smtpError) && smtpError.Code >= 500: // Mailbox unavailable and such
+        return reasonInvalid, true
+    default:
+        return reasonUnavailable, false
+    }
+}
+
+// Wording Of LINE Errors For A Chat That Blocked Or Removed The Bot
+var lineBlockedMessages = []string{"block", "unfollow", "not a friend", "not a member", "left the group", "left the room"}
+
+// Wording Of LINE 403 Errors For The Channel Itself, Which Say Nothing About The Chat
+var lineChannelMessages = []string{"not available for your account", "not allowed to use", "your plan"}
+
+func classifyLINEError(apiError *linebot.APIError) (string, bool) {
+    switch apiError.Code {
+    case http.StatusBadRequest:
+        // Malformed messages are 400 too, only a rejected "to" is about the chat
+        if lineErrorMentions(apiError, lineBlockedMessages) {
+            return reasonBlocked, true
+        }
+        if apiError.Response != nil {
+            for _, detail := range apiError.Response.Details {
+                if detail.Property == "to" {
+                    return reasonInvalid, true
+                }
+            }
+        }
+        return reasonBadRequest, false
+    case http.StatusForbidden:
+        if lineErrorMentions(apiError, lineChannelMessages) {
+            return reasonForbidden, false
+        }
+        return reasonBlocked, true
+    case http.StatusNotFound:
+        return reasonNotFound, true
+    case http.StatusTooManyRequests:
+        return reasonRateLimited, false
+    default:
+        return reasonUnavailable, false
+    }
+}
+
+func lineErrorMentions(apiError *linebot.APIError, phrases []string) bool {
+    if apiError.Response == nil {
+        return false
+    }
+    messages := []string{apiError.Response.Message}
+    for _, detail := range apiError.Response.Details {
+        messages = append(messages, detail.Message)
+    }
+    for _, message := range messages {
+        for _, phrase := range phrases {
+            if strings.Contains(strings.ToLower(message), phrase) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func classifyTelegramError(telegramError *TelegramError) (string, bool) {
+    switch telegramError.Code {
+    case http.StatusBadRequest:
+        if strings.Contains(strings.ToLower(telegramError.Description), "chat not found") {
+            return reasonNotFound, true
+        }
+        return reasonBadRequest, false
+    case http.StatusForbidden: // Blocked by the user or kicked from the group
+        return reasonBlocked, true
+    case http.StatusTooManyRequests:
+        return reasonRateLimited, false
+    default:
+        return reasonUnavailable, false
+    }
+}
+
+func recordDelivery(id string, err error) {
+    // Losing the record only delays quarantine, so the push itself still counts
+    if dbErr := saveDelivery(id, err); dbErr != nil {
+        log.Println(fmt.Sprintf(`Recording delivery to %s failed : "%s".`, id, dbErr))
+    }
+}
+
+func saveDelivery(id string, err error) error {
+    if err != nil {
+        if reason, _ := classifyPushError(err); reason == reasonBadRequest || reason == reasonForbidden {
+            log.Println(fmt.Sprintf(`Push to %s was rejected (%s), not counted against the chat : "%s".`, id, reason, err))
+            return nil
+        }
+    }
+
+    tx, dbErr := db.Begin()
+    if dbErr != nil {
+        return dbErr
+    }
+    defer tx.Rollback()
+
+    if err == nil {
+        if _, dbErr = tx.Exec("update delivery set failures = 0 where id = ? and quarantined = 0", id); dbErr != nil {
+            return dbErr
+        }
+        return tx.Commit()
+    }
+
+    reason, permanent := classifyPushError(err)
+    if !permanent {
+        log.Println(fmt.Sprintf(`ID %s is temporarily unreachable (%s) : "%s".`, id, reason, err))
+        if _, dbErr = tx.Exec("insert into delivery (id, failures, reason, error, updated_at) values (?, 0, ?, ?, datetime('now', 'localtime')) on conflict(id) do update set reason = excluded.reason, error = excluded.error, updated_at = excluded.updated_at", id, reason, err.Error()); dbErr != nil {
+            return dbErr
+        }
+        return tx.Commit()
+    }
+
+    if _, dbErr = tx.Exec("insert into delivery (id, failures, reason, error, updated_at) values (?, 1, ?, ?, datetime('now', 'localtime')) on conflict(id) do update set failures = failures + 1, reason = excluded.reason, error = excluded.error, updated_at = excluded.updated_at", id, reason, err.Error()); dbErr != nil {
+        return dbErr
+    }
+
+    var failures int
+    if dbErr = tx.QueryRow("select failures from delivery where id = ?", id).Scan(&failures); dbErr != nil {
+        return dbErr
+    }
+    if failures >= quarantineThreshold() {
+        if _, dbErr = tx.Exec("update delivery set quarantined = 1 where id = ?", id); dbErr != nil {
+            return dbErr
+        }
+        log.Println(fmt.Sprintf(`ID %s is quarantined after %d failed deliveries (%s) : "%s".`, id, failures, reason, err))
+    } else {
+        log.Println(fmt.Sprintf(`ID %s failed %d deliveries (%s) : "%s".`, id, failures, reason, err))
+    }
+    return tx.Commit()
+}
+
+func quarantineThreshold() int {
+    if threshold, err := strconv.Atoi(os.Getenv("QuarantineThreshold")); err == nil && threshold > 0 {
+        return threshold
+    }
+    return defaultQuarantineThreshold
+}
+
+func isQuarantined(id string) (bool, error) {
+    var quarantined int
+    err := db.QueryRow("select count(*) from delivery where id = ? and quarantined = 1", id).Scan(&quarantined)
+    return quarantined == 1, err
+}
+
+func isAdmin(id string) bool {
+    return id != "" && contains(strings.Split(os.Getenv("AdminIDs"), ","), id)
+}
+
+func replyQuarantined() (string, error) {
+    rows, err := db.Query("select id, failures, reason, datetime(updated_at) from delivery where quarantined = 1 order by updated_at desc")
+    if err != nil {
+        return "", err
+    }
+    defer rows.Close()
+
+    response := "已隔離的對話："
+    rowNums := 0
+    for rows.Next() {
+        var id, reason, updatedAt string
+        var failures int
+        if err = rows.Scan(&id, &failures, &reason, &updatedAt); err != nil {
+            return "", err
+        }
+        response += fmt.Sprintf("\n%s\n  %s，失敗%d次，%s", id, reason, failures, updatedAt)
+        rowNums += 1
+    }
+    if rowNums == 0 {
+        response = "目前沒有被隔離的對話"
+    }
+
+    return response, rows.Err()
+}
+
+func restoreQuarantined(arguments []string) (int, error) {
+    /*
+       int : number of restored chats
+    */
+
+    if contains(arguments, "all") {
+        result, err := db.Exec("delete from delivery where quarantined = 1")
+        if err != nil {
+            return 0, err
+        }
+        restored, _ := result.RowsAffected()
+        return int(restored), nil
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+
+    restored := 0
+    for _, argument := range arguments {
+        result, err := tx.Exec("delete from delivery where id = ? and quarantined = 1", argument)
+        if err != nil {
+            return 0, err
+        }
+        affected, _ := result.RowsAffected()
+        restored += int(affected)
+    }
+    return restored, tx.Commit()
+}
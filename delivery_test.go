@@ -0,0 +1,57 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/textproto"
+    "testing"
+
+    "github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+func lineError(code int, body string) error {
+    var response linebot.ErrorResponse
+    if err := json.Unmarshal([]byte(body), &response); err != nil {
+        panic(err)
+    }
+    return &linebot.APIError{Code: code, Response: &response}
+}
+
+func TestClassifyPushError(t *testing.T) {
+    tests := []struct {
+        name      string
+        err       error
+        reason    string
+        permanent bool
+    }{
+        {"line invalid recipient", lineError(400, `{"message":"The request body has 1 error(s)","details":[{"message":"Invalid user ID","property":"to"}]}`), reasonInvalid, true},
+        {"line malformed message", lineError(400, `{"message":"The request body has 1 error(s)","details":[{"message":"invalid JSON","property":"messages[0].contents"}]}`), reasonBadRequest, false},
+        {"line bad request without details", lineError(400, `{"message":"Invalid reply token"}`), reasonBadRequest, false},
+        {"line channel forbidden", lineError(403, `{"message":"Access to this API is not available for your account"}`), reasonForbidden, false},
+        {"line blocked by the user", lineError(403, `{"message":"The user has blocked the bot"}`), reasonBlocked, true},
+        {"line kicked from the group", lineError(403, `{"message":"Forbidden"}`), reasonBlocked, true},
+        {"line not a friend", lineError(400, `{"message":"Failed to send messages","details":[{"message":"The user is not a friend of the bot","property":"to"}]}`), reasonBlocked, true},
+        {"line left the group", lineError(400, `{"message":"The bot is not a member of the group"}`), reasonBlocked, true},
+        {"line chat not found", lineError(404, `{"message":"Not found"}`), reasonNotFound, true},
+        {"line rate limited", lineError(429, `{"message":"You have reached your monthly limit."}`), reasonRateLimited, false},
+        {"line server error", lineError(500, `{"message":"Internal server error"}`), reasonUnavailable, false},
+        {"telegram blocked", &TelegramError{Code: 403, Description: "Forbidden: bot was blocked by the user"}, reasonBlocked, true},
+        {"telegram chat not found", &TelegramError{Code: 400, Description: "Bad Request: chat not found"}, reasonNotFound, true},
+        {"telegram malformed message", &TelegramError{Code: 400, Description: "Bad Request: can't parse entities"}, reasonBadRequest, false},
+        {"telegram rate limited", &TelegramError{Code: 429, Description: "Too Many Requests: retry after 5"}, reasonRateLimited, false},
+        {"wrapped telegram blocked", fmt.Errorf("push: %w", &TelegramError{Code: 403, Description: "Forbidden: bot was kicked from the group chat"}), reasonBlocked, true},
+        {"smtp mailbox unavailable", &textproto.Error{Code: 550, Msg: "mailbox unavailable"}, reasonInvalid, true},
+        {"smtp temporary failure", &textproto.Error{Code: 451, Msg: "try again later"}, reasonUnavailable, false},
+        {"network failure", errors.New("dial tcp: i/o timeout"), reasonUnavailable, false},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            reason, permanent := classifyPushError(test.err)
+            if reason != test.reason || permanent != test.permanent {
+                t.Errorf("classifyPushError(%v) = %s, %v, want %s, %v", test.err, reason, permanent, test.reason, test.permanent)
+            }
+        })
+    }
+}
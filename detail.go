@@ -0,0 +1,91 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "time"
+
+    "github.com/icza/dyno"
+    "github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// Radius Searched For Other Defects Around A Detailed One, In Meters
+const detailNearbyRadius = 50
+
+// Days Before And After A Detailed Defect Searched For Others Around It
+const detailNearbyDays = 30
+
+func detail(seq string) (linebot.FlexContainer, bool, error) {
+    // Initial empty flexbox for line
+    flexJson := []byte(`{"type":"carousel","contents":[]}`)
+    var flex interface{}
+    json.Unmarshal(flexJson, &flex)
+
+    defectDetail, ok, err := retriveDefect(seq)
+    if err != nil {
+        return nil, false, err
+    }
+    if !ok {
+        listItemJson := []byte(fmt.Sprintf(`{"type":"bubble","size":"kilo","body":{"type":"box","layout":"vertical","contents":[{"type":"text","text":"#%s","size":"xl"},{"type":"text","text":"沒有任何資料","size":"xl"}],"alignItems":"center","justifyContent":"center"}}`, seq))
+        var listItem interface{}
+        json.Unmarshal(listItemJson, &listItem)
+        dyno.Append(flex, listItem, "contents")
+    } else {
+        dyno.Append(flex, fullDetailBubble(defectDetail), "contents")
+
+        // Other defects around, reported close to the same date so the whole recv isn't scanned
+        date, dateErr := time.ParseInLocation("2006-01-02", defectDetail.markdate, remoteZone)
+        if lat, lng, located := detailLocation(defectDetail); located && dateErr == nil {
+            area := &Geofence{kind: "near", lat: lat, lng: lng, radius: detailNearbyRadius}
+            query := DefectQuery{markids: []string{"all"}, from: date.AddDate(0, 0, -detailNearbyDays), to: date.AddDate(0, 0, detailNearbyDays+1).Add(-time.Second), page: 1, area: area}
+            nearbyDetails, distances, err := retriveNearbyDefects(query)
+            if err != nil {
+                return nil, false, err
+            }
+            for i, nearbyDetail := range nearbyDetails {
+                if nearbyDetail.seq_id == defectDetail.seq_id {
+                    continue
+                }
+                listItem := detailBubble(nearbyDetail)
+                dyno.Append(listItem, distanceRow(distances[i]), "body", "contents")
+                dyno.Append(flex, listItem, "contents")
+            }
+        }
+    }
+
+    // Interface to line flex struct
+    flexResult, _ := json.Marshal(flex)
+    container, err := linebot.UnmarshalFlexMessageJSON(flexResult)
+    if err != nil {
+        return nil, false, err
+    }
+
+    return container, ok, nil
+}
+
+func fullDetailBubble(defectDetail DefectDetail) interface{} {
+    var defectTypeName string
+    if defectName(defectDetail.markid) == "" {
+        defectTypeName = defectDetail.markid
+    } else {
+        defectTypeName = defectName(defectDetail.markid) + `(` + defectDetail.markid + `)`
+    }
+    photoPreviewUri, photoUri := photoURIs(defectDetail)
+    gps := fmt.Sprintf(`%s,%s`, defectDetail.gps_y, defectDetail.gps_x)
+    var address string
+    if defectDetail.address != "" {
+        address = defectDetail.address
+    } else {
+        address = `資料庫內沒有地址`
+    }
+
+    listItemJson := []byte(fmt.Sprintf(`{"type":"bubble","size":"mega","hero":{"type":"box","layout":"vertical","contents":[{"type":"image","url":"%s","size":"full","aspectMode":"cover","aspectRatio":"4:3","action":{"type":"uri","label":"action","uri":"%s"}},{"type":"image","url":"https://dev.virtualearth.net/REST/V1/Imagery/Map/Road/%s/17?mapSize=800,600&format=jpeg&pushpin=%s;90;&key=AmkZpObWs0kj2Yu2XYjj85i3qz_JZYzXQ_W26LYkFJtPY0Hw029eIWEJivjhGx0E","size":"full","aspectMode":"cover","aspectRatio":"4:3","action":{"type":"uri","label":"action","uri":"http://www.google.com/maps/place/%s"}}]},"body":{"type":"box","layout":"vertical","contents":[{"type":"text","text":"%s","weight":"bold","size":"xl","wrap":true},{"type":"text","text":"%s %s","color":"#aaaaaa","size":"sm"},{"type":"separator","margin":"md"},{"type":"box","layout":"baseline","contents":[{"type":"icon","size":"xs","url":"https://akveo.github.io/eva-icons/outline/png/128/hash-outline.png"},{"type":"text","text":"%s","size":"md","color":"#8c8c8c","margin":"sm"}],"margin":"md"},{"type":"box","layout":"baseline","contents":[{"type":"icon","size":"xs","url":"https://akveo.github.io/eva-icons/outline/png/128/pin-outline.png"},{"type":"text","text":"%s","size":"md","color":"#8c8c8c","margin":"sm"}]},{"type":"box","layout":"baseline","contents":[{"type":"icon","size":"xs","url":"https://akveo.github.io/eva-icons/outline/png/128/map-outline.png"},{"type":"text","text":"%s","wrap":true,"color":"#8c8c8c","size":"md","margin":"sm"}]}],"spacing":"sm","paddingAll":"13px"},"footer":{"type":"box","layout":"horizontal","contents":[{"type":"button","action":{"type":"uri","label":"原始照片","uri":"%s"},"height":"sm"},{"type":"button","action":{"type":"uri","label":"開啟地圖","uri":"http://www.google.com/maps/place/%s"},"height":"sm"}]},"styles":{"footer":{"separator":true}}}`, photoPreviewUri, photoUri, gps, gps, gps, escapeJSON(defectTypeName), defectDetail.markdate, defectDetail.marktime, defectDetail.seq_id, gps, escapeJSON(address), photoUri, gps))
+    var listItem interface{}
+    json.Unmarshal(listItemJson, &listItem)
+
+    return listItem
+}
+
+func retriveDefect(seq string) (DefectDetail, bool, error) {
+    return source.Defect(seq)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+    "bytes"
+    "crypto/rand"
+    "encoding/base64"
+    "encoding/hex"
+    "fmt"
+    "html"
+    "mime"
+    "net/smtp"
+    "os"
+    "strings"
+    "time"
+)
+
+type emailNotifier struct{}
+
+func (emailNotifier) Push(id string, report Report, skipEmpty bool) (bool, error) {
+    data, err := retriveReportData(id, report)
+    if err != nil {
+        return false, err
+    }
+    if skipEmpty && report.text == "" && data.total == 0 {
+        return false, nil
+    }
+
+    to := strings.TrimPrefix(id, emailPrefix)
+    err = sendEmail(to, report.title, renderEmailText(report, data), renderEmailHTML(report, data))
+    recordDelivery(id, err)
+    return true, err
+}
+
+func sendEmail(to string, subject string, text string, htmlText string) error {
+    host := os.Getenv("SMTPHost")
+    if host == "" {
+        return fmt.Errorf("SMTPHost is not set")
+    }
+    from := os.Getenv("SMTPFrom")
+
+    buffer := make([]byte, 12)
+    rand.Read(buffer)
+    boundary := hex.EncodeToString(buffer)
+
+    var message bytes.Buffer
+    fmt.Fprintf(&message, "From: %s\r\n", from)
+    fmt.Fprintf(&message, "To: %s\r\n", to)
+    fmt.Fprintf(&message, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", subject))
+    fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+    fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+    fmt.Fprintf(&message, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary)
+    fmt.Fprintf(&message, "--%s\r\nContent-Type: text/plain; charset=UTF-8\r\nContent-Transfer-Encoding: base64\r\n\r\n%s", boundary, encodeEmailBody(text))
+    fmt.Fprintf(&message, "--%s\r\nContent-Type: text/html; charset=UTF-8\r\nContent-Transfer-Encoding: base64\r\n\r\n%s", boundary, encodeEmailBody(htmlText))
+    fmt.Fprintf(&message, "--%s--\r\n", boundary)
+
+    var auth smtp.Auth
+    if user := os.Getenv("SMTPUser"); user != "" {
+        auth = smtp.PlainAuth("", user, os.Getenv("SMTPPassword"), host)
+    }
+    return smtp.SendMail(fmt.Sprintf("%s:%s", host, os.Getenv("SMTPPort")), auth, from, []string{to}, message.Bytes())
+}
+
+func encodeEmailBody(body string) string {
+    // Base64 in lines of 76, since SMTP limits the length of lines
+    encoded := base64.StdEncoding.EncodeToString([]byte(body))
+    var lines strings.Builder
+    for len(encoded) > 76 {
+        lines.WriteString(encoded[:76] + "\r\n")
+        encoded = encoded[76:]
+    }
+    lines.WriteString(encoded + "\r\n")
+    return lines.String()
+}
+
+func renderEmailText(report Report, data reportData) string {
+    var text strings.Builder
+    if report.header != "" {
+        text.WriteString(report.header + "\r\n\r\n")
+    }
+    if report.text != "" {
+        text.WriteString(report.text + "\r\n")
+        return text.String()
+    }
+
+    text.WriteString(fmt.Sprintf("%s，%s\r\n", report.title, formatCondition(report.query)))
+    if data.total == 0 {
+        text.WriteString("沒有任何資料\r\n")
+        return text.String()
+    }
+    for _, defect := range data.defects {
+        text.WriteString(fmt.Sprintf("%s：%d筆\r\n", formatDefectType(defect.markid), defect.num))
+    }
+    for _, defectDetail := range data.details {
+        _, photoUri := photoURIs(defectDetail)
+        text.WriteString(fmt.Sprintf("\r\n%s %s %s #%s\r\n%s\r\n%s\r\nhttp://www.google.com/maps/place/%s,%s\r\n", formatDefectType(defectDetail.markid), defectDetail.markdate, defectDetail.marktime, defectDetail.seq_id, defectDetail.address, photoUri, defectDetail.gps_y, defectDetail.gps_x))
+    }
+    if data.hasNext {
+        text.WriteString(fmt.Sprintf("\r\n僅列出前%d筆，共%d筆\r\n", pageSize, data.total))
+    }
+    return text.String()
+}
+
+func renderEmailHTML(report Report, data reportData) string {
+    var body strings.Builder
+    body.WriteString(`<html><body style="font-family:sans-serif">`)
+    if report.header != "" {
+        body.WriteString("<p>" + html.EscapeString(report.header) + "</p>")
+    }
+    if report.text != "" {
+        body.WriteString("<p>" + strings.ReplaceAll(html.EscapeString(report.text), "\n", "<br>") + "</p></body></html>")
+        return body.String()
+    }
+
+    body.WriteString(fmt.Sprintf(`<h2>%s</h2><p style="color:#aaaaaa">%s</p>`, html.EscapeString(report.title), html.EscapeString(formatCondition(report.query))))
+    if data.total == 0 {
+        body.WriteString("<p>沒有任何資料</p></body></html>")
+        return body.String()
+    }
+    body.WriteString(`<table cellpadding="4">`)
+    for _, defect := range data.defects {
+        body.WriteString(fmt.Sprintf(`<tr><td>%s</td><td align="right">%d筆</td></tr>`, html.EscapeString(formatDefectType(defect.markid)), defect.num))
+    }
+    body.WriteString(`</table>`)
+    for _, defectDetail := range data.details {
+        photoPreviewUri, photoUri := photoURIs(defectDetail)
+        gps := fmt.Sprintf(`%s,%s`, defectDetail.gps_y, defectDetail.gps_x)
+        body.WriteString(fmt.Sprintf(`<hr><p><b>%s</b> <span style="color:#aaaaaa">%s %s #%s</span><br>%s<br><a href="http://www.google.com/maps/place/%s">%s</a></p><a href="%s"><img src="%s" width="400" alt="%s"></a>`,
+            html.EscapeString(formatDefectType(defectDetail.markid)), html.EscapeString(defectDetail.markdate), html.EscapeString(defectDetail.marktime), html.EscapeString(defectDetail.seq_id), html.EscapeString(defectDetail.address), html.EscapeString(gps), html.EscapeString(gps), html.EscapeString(photoUri), html.EscapeString(photoPreviewUri), html.EscapeString(defectDetail.seq_id)))
+    }
+    if data.hasNext {
+        body.WriteString(fmt.Sprintf(`<hr><p>僅列出前%d筆，共%d筆</p>`, pageSize, data.total))
+    }
+    body.WriteString(`</body></html>`)
+    return body.String()
+}
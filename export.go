@@ -0,0 +1,218 @@
+package main
+
+import (
+    "archive/zip"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/csv"
+    "encoding/hex"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// How Long A Download Link From export Stays Valid
+const exportLinkTTL = time.Hour
+
+// Columns Of Exported Files
+var exportColumns = []string{"seq_id", "markid", "名稱", "日期", "時間", "緯度", "經度", "地址", "預覽照片", "原始照片"}
+
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+    values := r.URL.Query()
+    format := values.Get("format")
+    if format == "" {
+        format = "csv"
+    }
+    if format != "csv" && format != "xlsx" {
+        http.Error(w, "Format unaccepted.", http.StatusBadRequest)
+        return
+    }
+
+    var id string
+    var query DefectQuery
+    var err error
+    if values.Get("sig") != "" { // Download link replied by export command
+        if !verifySignedLink(values) {
+            http.Error(w, "Link expired or invalid.", http.StatusForbidden)
+            return
+        }
+        id = values.Get("id")
+        query, err = decodeQuery(values)
+    } else {
+        if !authorized(r, scopeRead) {
+            http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+            return
+        }
+        query, err = exportQuery(values)
+    }
+    if err != nil {
+        http.Error(w, "Format unaccepted.", http.StatusBadRequest)
+        return
+    }
+
+    filename := "defects-" + time.Now().In(remoteZone).Format("20060102150405") + "." + format
+    w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+    var rowNums int
+    if format == "xlsx" {
+        w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+        rowNums, err = exportXLSX(w, id, query)
+    } else {
+        w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+        rowNums, err = exportCSV(w, id, query)
+    }
+    if err != nil {
+        log.Println(fmt.Sprintf(`Export of %s stopped after %d rows : "%s".`, id, rowNums, err))
+        return
+    }
+    log.Println(fmt.Sprintf("Exported %d rows as %s.", rowNums, format))
+}
+
+func exportQuery(values url.Values) (DefectQuery, error) {
+    // Same arguments as inspect, e.g. defects=D10.D20&period=2026-10-01..2026-10-31&area=in 中正區
+    var arguments []string
+    if defects := values.Get("defects"); defects != "" {
+        arguments = append(arguments, strings.Split(defects, ".")...)
+    }
+    if period := values.Get("period"); period != "" {
+        arguments = append(arguments, period)
+    }
+    if area := values.Get("area"); area != "" {
+        arguments = append(arguments, strings.Fields(area)...)
+    }
+    query, err := queryArguments(arguments)
+    if err != nil {
+        return query, err
+    }
+    if query.keyword = values.Get("keyword"); !matchString(`^[^"\\%_]*$`, query.keyword) {
+        return query, fmt.Errorf("invalid keyword")
+    }
+    if len(query.markids) == 0 { // There's no chat to take subscriptions from
+        query.markids = []string{"all"}
+    }
+    return query, nil
+}
+
+func exportLink(id string, query DefectQuery, format string) string {
+    if query.window != 0 { // Fix the period at the time the link is made
+        query.to = time.Now().In(remoteZone)
+        query.from, query.window = query.to.Add(-query.window), 0
+    }
+    values := encodeQuery(query)
+    values.Set("id", id)
+    values.Set("format", format)
+    values.Set("expires", strconv.FormatInt(time.Now().Add(exportLinkTTL).Unix(), 10))
+    values.Set("sig", linkSignature(values))
+    return strings.TrimSuffix(os.Getenv("PublicURL"), "/") + "/export?" + values.Encode()
+}
+
+func linkSignature(values url.Values) string {
+    signed := url.Values{}
+    for key, value := range values {
+        if key != "sig" {
+            signed[key] = value
+        }
+    }
+    mac := hmac.New(sha256.New, []byte(os.Getenv("LinkSecret")))
+    mac.Write([]byte(signed.Encode()))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+func verifySignedLink(values url.Values) bool {
+    if os.Getenv("LinkSecret") == "" { // Anyone could sign with an empty key
+        return false
+    }
+    expires, err := strconv.ParseInt(values.Get("expires"), 10, 64)
+    if err != nil || time.Now().Unix() > expires {
+        return false
+    }
+    return hmac.Equal([]byte(values.Get("sig")), []byte(linkSignature(values)))
+}
+
+func retriveExportRows(id string, query DefectQuery, row func([]string) error) (int, error) {
+    /*
+       int : number of rows passed to row
+    */
+
+    query, ok, err := resolveQuery(id, query)
+    if !ok {
+        return 0, err
+    }
+
+    rowNums := 0
+    err = source.Defects(query, orderOldest, 0, 0, func(defectDetail DefectDetail) error {
+        photoPreviewUri, photoUri := photoURIs(defectDetail)
+        if err := row([]string{defectDetail.seq_id, defectDetail.markid, defectName(defectDetail.markid), defectDetail.markdate, defectDetail.marktime, defectDetail.gps_y, defectDetail.gps_x, defectDetail.address, photoPreviewUri, photoUri}); err != nil {
+            return err
+        }
+        rowNums += 1
+        return nil
+    })
+    return rowNums, err
+}
+
+func exportCSV(w http.ResponseWriter, id string, query DefectQuery) (int, error) {
+    io.WriteString(w, "\ufeff") // Byte order mark, or Excel won't read it as UTF-8
+    writer := csv.NewWriter(w)
+    writer.Write(exportColumns)
+    rowNums, err := retriveExportRows(id, query, func(record []string) error {
+        return writer.Write(record)
+    })
+    writer.Flush()
+    if err == nil {
+        err = writer.Error()
+    }
+    return rowNums, err
+}
+
+func exportXLSX(w http.ResponseWriter, id string, query DefectQuery) (int, error) {
+    archive := zip.NewWriter(w)
+    parts := [][2]string{
+        {"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?><Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+        {"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?><Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+        {"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?><workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="defects" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+        {"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?><Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+    }
+    for _, part := range parts {
+        file, err := archive.Create(part[0])
+        if err != nil {
+            return 0, err
+        }
+        io.WriteString(file, part[1])
+    }
+
+    // Rows are streamed into the sheet as they are fetched
+    sheet, err := archive.Create("xl/worksheets/sheet1.xml")
+    if err != nil {
+        return 0, err
+    }
+    io.WriteString(sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?><worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+    writeXLSXRow(sheet, exportColumns)
+    rowNums, err := retriveExportRows(id, query, func(record []string) error {
+        return writeXLSXRow(sheet, record)
+    })
+    if err != nil {
+        return rowNums, err
+    }
+    io.WriteString(sheet, `</sheetData></worksheet>`)
+    return rowNums, archive.Close()
+}
+
+func writeXLSXRow(w io.Writer, record []string) error {
+    var row strings.Builder
+    row.WriteString("<row>")
+    for _, cell := range record {
+        row.WriteString(`<c t="inlineStr"><is><t>`)
+        xml.EscapeText(&row, []byte(cell))
+        row.WriteString(`</t></is></c>`)
+    }
+    row.WriteString("</row>")
+    _, err := io.WriteString(w, row.String())
+    return err
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "math"
+    "os"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// Declare Global Named Polygons Loaded From GeoJSON
+var geofences map[string]Geofence
+
+// Radius Used When sub near Omits It, In Meters
+const defaultRadius = 500
+
+// Mean Radius Of The Earth, In Meters
+const earthRadius = 6371000
+
+// A Chat Has One Area For All Of Its Subscriptions
+var errAreaConflict = errors.New("chat already subscribes another area")
+
+func loadGeofences() {
+    geofences = make(map[string]Geofence)
+    path := os.Getenv("GeofenceFile")
+    if path == "" {
+        return
+    }
+
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        log.Fatal("Loading geofence file error : ", err)
+    }
+
+    var collection struct {
+        Features []struct {
+            Properties struct {
+                Name string `json:"name"`
+            } `json:"properties"`
+            Geometry struct {
+                Type        string          `json:"type"`
+                Coordinates json.RawMessage `json:"coordinates"`
+            } `json:"geometry"`
+        } `json:"features"`
+    }
+    if err = json.Unmarshal(content, &collection); err != nil {
+        log.Fatal("Parsing geofence file error : ", err)
+    }
+
+    for _, feature := range collection.Features {
+        if feature.Properties.Name == "" {
+            continue
+        }
+        var polygons [][][][2]float64
+        switch feature.Geometry.Type {
+        case "Polygon":
+            var polygon [][][2]float64
+            err = json.Unmarshal(feature.Geometry.Coordinates, &polygon)
+            polygons = append(polygons, polygon)
+        case "MultiPolygon":
+            err = json.Unmarshal(feature.Geometry.Coordinates, &polygons)
+        default:
+            continue
+        }
+        if err != nil {
+            log.Fatal("Parsing geofence "+feature.Properties.Name+" error : ", err)
+        }
+        geofences[feature.Properties.Name] = Geofence{kind: "polygon", name: feature.Properties.Name, polygons: polygons}
+    }
+    log.Println(fmt.Sprintf("Loaded %d geofences.", len(geofences)))
+}
+
+func areaArguments(arguments []string) ([]string, *Geofence, error) {
+    /*
+       []string : arguments without the area
+       *Geofence : area in arguments, nil if there's none
+    */
+
+    var rest []string
+    var area *Geofence
+    for i := 0; i < len(arguments); i++ {
+        switch {
+        case arguments[i] == "near" && area == nil && i+1 < len(arguments):
+            coordinates := strings.Split(arguments[i+1], ",")
+            if len(coordinates) != 2 {
+                return rest, nil, errors.New("")
+            }
+            lat, err := strconv.ParseFloat(coordinates[0], 64)
+            if err != nil || lat < -90 || lat > 90 {
+                return rest, nil, errors.New("")
+            }
+            lng, err := strconv.ParseFloat(coordinates[1], 64)
+            if err != nil || lng < -180 || lng > 180 {
+                return rest, nil, errors.New("")
+            }
+            area = &Geofence{kind: "near", lat: lat, lng: lng, radius: defaultRadius}
+            i++
+            if i+1 < len(arguments) {
+                if radius, ok := parseRadius(arguments[i+1]); ok {
+                    area.radius = radius
+                    i++
+                }
+            }
+        case arguments[i] == "in" && area == nil && i+1 < len(arguments):
+            if _, ok := geofences[arguments[i+1]]; !ok {
+                return rest, nil, errors.New("")
+            }
+            area = &Geofence{kind: "polygon", name: arguments[i+1]}
+            i++
+        default:
+            rest = append(rest, arguments[i])
+        }
+    }
+    if rest == nil {
+        rest = []string{}
+    }
+    return rest, area, nil
+}
+
+func parseRadius(s string) (float64, bool) {
+    matches := regexp.MustCompile(`^([1-9]\d*)(m|km)$`).FindStringSubmatch(s)
+    if matches == nil {
+        return 0, false
+    }
+    radius, _ := strconv.ParseFloat(matches[1], 64)
+    if matches[2] == "km" {
+        radius *= 1000
+    }
+    return radius, true
+}
+
+func retriveGeofence(id string) (*Geofence, error) {
+    var area Geofence
+    var name sql.NullString
+    err := db.QueryRow("select kind, lat, lng, radius, name from geofence where id = ?", id).Scan(&area.kind, &area.lat, &area.lng, &area.radius, &name)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    area.name = name.String
+    return &area, nil
+}
+
+func checkGeofence(id string, area *Geofence) (*Geofence, error) {
+    /*
+       *Geofence : area the chat already subscribes, nil if there's none
+       error : errAreaConflict if it's not area
+    */
+
+    current, err := retriveGeofence(id)
+    if err != nil {
+        return nil, err
+    }
+    if current != nil && current.describe() != area.describe() {
+        return current, errAreaConflict
+    }
+    return current, nil
+}
+
+func setGeofence(id string, area *Geofence) error {
+    _, err := db.Exec("insert into geofence (id, kind, lat, lng, radius, name) values (?, ?, ?, ?, ?, ?) on conflict(id) do update set kind = excluded.kind, lat = excluded.lat, lng = excluded.lng, radius = excluded.radius, name = excluded.name", id, area.kind, area.lat, area.lng, area.radius, area.name)
+    return err
+}
+
+func removeGeofence(id string) error {
+    _, err := db.Exec("delete from geofence where id = ?", id)
+    return err
+}
+
+func (area Geofence) resolve() Geofence {
+    if area.kind == "polygon" && area.polygons == nil {
+        if polygon, ok := geofences[area.name]; ok {
+            return polygon
+        }
+        log.Println("Geofence " + area.name + " is missing in geofence file.")
+    }
+    return area
+}
+
+func (area Geofence) bounds() (float64, float64, float64, float64) {
+    /*
+       return : minimum latitude, maximum latitude, minimum longitude, maximum longitude
+    */
+
+    if area.kind == "near" {
+        latDelta := area.radius / earthRadius * 180 / math.Pi
+        lngDelta := latDelta / math.Max(math.Cos(area.lat*math.Pi/180), 0.01)
+        return area.lat - latDelta, area.lat + latDelta, area.lng - lngDelta, area.lng + lngDelta
+    }
+
+    minLat, maxLat, minLng, maxLng := 90.0, -90.0, 180.0, -180.0
+    for _, polygon := range area.polygons {
+        for _, ring := range polygon {
+            for _, point := range ring {
+                minLng, maxLng = math.Min(minLng, point[0]), math.Max(maxLng, point[0])
+                minLat, maxLat = math.Min(minLat, point[1]), math.Max(maxLat, point[1])
+            }
+        }
+    }
+    return minLat, maxLat, minLng, maxLng
+}
+
+func (area Geofence) contains(lat float64, lng float64) bool {
+    if area.kind == "near" {
+        return distance(area.lat, area.lng, lat, lng) <= area.radius
+    }
+
+    for _, polygon := range area.polygons {
+        if len(polygon) == 0 || !ringContains(polygon[0], lat, lng) {
+            continue
+        }
+        hole := false
+        for _, ring := range polygon[1:] {
+            if ringContains(ring, lat, lng) {
+                hole = true
+                break
+            }
+        }
+        if !hole {
+            return true
+        }
+    }
+    return false
+}
+
+func (area Geofence) describe() string {
+    if area.kind == "near" {
+        return fmt.Sprintf("%.6f,%.6f 半徑%s", area.lat, area.lng, formatDistance(area.radius))
+    }
+    return area.name
+}
+
+func ringContains(ring [][2]float64, lat float64, lng float64) bool {
+    // Ray casting, points are [longitude, latitude]
+    inside := false
+    for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+        if (ring[i][1] > lat) != (ring[j][1] > lat) && lng < (ring[j][0]-ring[i][0])*(lat-ring[i][1])/(ring[j][1]-ring[i][1])+ring[i][0] {
+            inside = !inside
+        }
+    }
+    return inside
+}
+
+func distance(lat1 float64, lng1 float64, lat2 float64, lng2 float64) float64 {
+    // Haversine formula, in meters
+    dLat := (lat2 - lat1) * math.Pi / 180
+    dLng := (lng2 - lng1) * math.Pi / 180
+    a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*math.Pi/180)*math.Cos(lat2*math.Pi/180)*math.Sin(dLng/2)*math.Sin(dLng/2)
+    return earthRadius * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+func formatDistance(meters float64) string {
+    if meters >= 1000 {
+        return strconv.FormatFloat(math.Round(meters/100)/10, 'f', -1, 64) + "公里"
+    }
+    return strconv.FormatFloat(math.Round(meters), 'f', -1, 64) + "公尺"
+}
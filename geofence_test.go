@@ -0,0 +1,80 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestGeofenceContains(t *testing.T) {
+    // Taipei Main Station, 500m around it
+    near := Geofence{kind: "near", lat: 25.0478, lng: 121.5170, radius: 500}
+    // A square with a square hole, points are [longitude, latitude]
+    square := Geofence{kind: "polygon", name: "square", polygons: [][][][2]float64{{
+        {{121.50, 25.00}, {121.60, 25.00}, {121.60, 25.10}, {121.50, 25.10}, {121.50, 25.00}},
+        {{121.54, 25.04}, {121.56, 25.04}, {121.56, 25.06}, {121.54, 25.06}, {121.54, 25.04}},
+    }}}
+    // Two triangles as a MultiPolygon
+    islands := Geofence{kind: "polygon", name: "islands", polygons: [][][][2]float64{
+        {{{121.0, 25.0}, {121.1, 25.0}, {121.0, 25.1}, {121.0, 25.0}}},
+        {{{122.0, 25.0}, {122.1, 25.0}, {122.0, 25.1}, {122.0, 25.0}}},
+    }}
+
+    tests := []struct {
+        name string
+        area Geofence
+        lat  float64
+        lng  float64
+        want bool
+    }{
+        {"center", near, 25.0478, 121.5170, true},
+        {"inside radius", near, 25.0500, 121.5190, true},
+        {"just inside radius", near, 25.0478 + 0.0044, 121.5170, true},
+        {"just outside radius", near, 25.0478 + 0.0046, 121.5170, false},
+        {"far away", near, 24.1477, 120.6736, false},
+        {"inside polygon", square, 25.02, 121.52, true},
+        {"inside hole", square, 25.05, 121.55, false},
+        {"outside polygon", square, 25.20, 121.52, false},
+        {"first of multipolygon", islands, 25.02, 121.02, true},
+        {"second of multipolygon", islands, 25.02, 122.02, true},
+        {"between multipolygon", islands, 25.02, 121.50, false},
+        {"outside triangle", islands, 25.09, 121.09, false},
+    }
+
+    for _, test := range tests {
+        if got := test.area.contains(test.lat, test.lng); got != test.want {
+            t.Errorf("%s: contains(%f, %f) = %v, want %v", test.name, test.lat, test.lng, got, test.want)
+        }
+    }
+}
+
+func TestGeofenceBounds(t *testing.T) {
+    near := Geofence{kind: "near", lat: 25.0478, lng: 121.5170, radius: 500}
+    minLat, maxLat, minLng, maxLng := near.bounds()
+    for _, point := range [][2]float64{{25.0478 + 0.0044, 121.5170}, {25.0478 - 0.0044, 121.5170}, {25.0478, 121.5170 + 0.0049}, {25.0478, 121.5170 - 0.0049}} {
+        if !near.contains(point[0], point[1]) {
+            t.Fatalf("%v should be inside", point)
+        }
+        if point[0] < minLat || point[0] > maxLat || point[1] < minLng || point[1] > maxLng {
+            t.Errorf("%v is inside the radius but outside bounds %f, %f, %f, %f", point, minLat, maxLat, minLng, maxLng)
+        }
+    }
+}
+
+func TestParseRadius(t *testing.T) {
+    tests := []struct {
+        s      string
+        radius float64
+        ok     bool
+    }{
+        {"500m", 500, true},
+        {"2km", 2000, true},
+        {"0m", 0, false},
+        {"1.5km", 0, false},
+        {"500", 0, false},
+    }
+
+    for _, test := range tests {
+        if radius, ok := parseRadius(test.s); radius != test.radius || ok != test.ok {
+            t.Errorf("parseRadius(%q) = %f, %v, want %f, %v", test.s, radius, ok, test.radius, test.ok)
+        }
+    }
+}
@@ -6,6 +6,7 @@ require (
 	github.com/go-sql-driver/mysql v1.6.0
 	github.com/gorilla/mux v1.8.0
 	github.com/joho/godotenv v1.4.0
+	github.com/lib/pq v1.9.0
 	github.com/line/line-bot-sdk-go/v7 v7.13.0
 	github.com/mattn/go-sqlite3 v1.14.12
 	github.com/robfig/cron/v3 v3.0.1
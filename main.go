@@ -7,14 +7,16 @@ import (
     "fmt"
     "log"
     "net/http"
+    "net/url"
     "os"
     "reflect"
     "regexp"
+    "sort"
     "strconv"
     "strings"
+    "sync"
     "time"
 
-    _ "github.com/go-sql-driver/mysql"
     "github.com/gorilla/mux"
     "github.com/icza/dyno"
     "github.com/joho/godotenv"
@@ -29,13 +31,35 @@ var bot *linebot.Client
 // Declare Global Local Database Interface
 var db *sql.DB
 
-// Declare Global Remote Database Interface
-var rdb *sql.DB
+// Declare Global Source Of Defects, The Remote Database
+var source DefectSource
 
-// Declare Global Roadmarks Name
-var defectnames map[string]string
+// Declare Global Roadmarks Name, Loaded Again Whenever The Remote Database Comes Back
+var defectnames = map[string]string{}
+var defectnamesLock sync.RWMutex
+
+// Declare Global Default Lookback Window
+var defaultWindow time.Duration = 80 * time.Minute
+
+// Declare Global Timezone Of Remote Data
+var remoteZone = time.FixedZone("UTC+8", 8*60*60)
+
+// Maximum Defect Details In One Carousel, Limited By LINE
+const pageSize = 11
+
+// Maximum Quick Reply Buttons In One Message, Limited By LINE
+const maxQuickReplies = 13
+
+// Maximum Length Of Postback Data, Limited By LINE
+const maxPostbackData = 300
 
 func main() {
+    // API Key Management, Only Needs The Local Database
+    if len(os.Args) > 1 && os.Args[1] == "apikey" {
+        db = intialLocalDatabase()
+        os.Exit(apikeyCommand(os.Args[2:]))
+    }
+
     // Load ENVs
     err := godotenv.Load()
     if err != nil {
@@ -45,6 +69,9 @@ func main() {
     } else {
         log.Println("Env loaded.")
     }
+    if window, ok := parseWindow(os.Getenv("DefaultWindow")); ok {
+        defaultWindow = window
+    }
 
     // Initialize Line Bot
     bot, err = linebot.New(os.Getenv("ChannelSecret"), os.Getenv("ChannelAccessToken"))
@@ -54,16 +81,26 @@ func main() {
         log.Println("Line bot initialized.")
     }
 
-    // Initialize Cron
-    go cronJob()
-
     // Initialize Database
     db = intialLocalDatabase()
-    rdb = intialRemoteDatabase()
+    source = intialRemoteDatabase()
+    loadGeofences()
+
+    // Initialize Cron
+    cronJob()
+
+    // Initialize Watcher
+    go watchJob()
 
     // Initialize Callback And Local API Interface
     router := mux.NewRouter()
     router.HandleFunc("/callback", callbackHandler)
+    router.HandleFunc("/chart.png", chartHandler)
+    router.HandleFunc("/export", exportHandler)
+    router.HandleFunc("/api/v1/defects", apiDefectsHandler).Methods("GET")
+    router.HandleFunc("/api/v1/summary", apiSummaryHandler).Methods("GET")
+    adminRoutes(router)
+    router.HandleFunc("/trigger", triggerPostHandler).Methods("POST")
     router.HandleFunc("/trigger", triggerHandler).Queries("id", `{id}`, "defects", `{defects}`)
     server := &http.Server{
         Addr:    fmt.Sprintf(":%s", os.Getenv("CallbackPort")),
@@ -93,15 +130,8 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
             case *linebot.TextMessage:
 
                 commandParameters := strings.Split(message.Text, " ")
-                var id string
-                switch event.Source.Type {
-                case "user":
-                    id = event.Source.UserID
-                case "group":
-                    id = event.Source.GroupID
-                case "room":
-                    id = event.Source.RoomID
-                default:
+                id, ok := sourceID(event)
+                if !ok {
                     replyTextMessage(event, "不支援的對話類型")
                     return
                 }
@@ -114,27 +144,7 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
                         return
                     }
 
-                    result, err := addSubscriber(id, arguments)
-
-                    var response string
-                    switch result {
-                    case 0:
-                        response = "訂閱缺陷種類" + strings.Join(arguments, " ") + "成功\n\n" + replyAllSubscribe(id)
-                    case 1:
-                        response = "訂閱全部缺陷種類成功\n\n" + replyAllSubscribe(id)
-                    case 2:
-                        response = "已經訂閱所有種類，此命令將被忽略\n若要取消訂閱所有種類請輸入unsub\n\n" + replyAllSubscribe(id)
-                    case 3:
-                        response = "命令格式不正確"
-                    }
-
-                    replyTextMessage(event, response)
-                    if len(arguments) == 0 {
-                        arguments = []string{"all"}
-                    }
-                    if err == nil {
-                        log.Println(fmt.Sprintf("User %s subscribing %s.", id, strings.Join(arguments, " ")))
-                    }
+                    subscribe(event, id, arguments)
                 case "unsub":
                     arguments, err := argumentSplitter(commandParameters)
                     if err != nil {
@@ -142,32 +152,14 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
                         return
                     }
 
-                    result, err := removeSubscriber(id, arguments)
-
-                    var response string
-                    switch result {
-                    case 0:
-                        response = "取消訂閱缺陷種類" + strings.Join(arguments, " ") + "成功\n\n" + replyAllSubscribe(id)
-                    case 1:
-                        response = "取消訂閱全部缺陷種類成功\n\n" + replyAllSubscribe(id)
-                    case 2:
-                        response = "移除所有訂閱成功\n\n" + replyAllSubscribe(id)
-                    case 3:
-                        response = "命令格式不正確"
-                    }
-
-                    replyTextMessage(event, response)
-                    if contains(arguments, "all") {
-                        arguments = []string{"all item"}
-                    }
-                    if len(arguments) == 0 {
-                        arguments = []string{"all"}
-                    }
-                    if err == nil {
-                        log.Println(fmt.Sprintf("User %s quit subscribing %s.", id, strings.Join(arguments, " ")))
-                    }
+                    unsubscribe(event, id, arguments)
                 case "list":
-                    replyTextMessage(event, replyAllSubscribe(id))
+                    response, err := replyAllSubscribe(id)
+                    if err != nil {
+                        replyFailure(event, id, "list", err)
+                        return
+                    }
+                    replySubscribeMessage(event, id, response, 0)
                     log.Println(fmt.Sprintf("User %s listed.", id))
                 case "inspect":
                     arguments, err := argumentSplitter(commandParameters)
@@ -176,7 +168,45 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
                         return
                     }
 
-                    response, _ := inspect(id, arguments)
+                    if len(arguments) == 1 && arguments[0] == "new" {
+                        query := DefectQuery{markids: []string{}, page: 1}
+                        watermark, err := retriveWatermark(id)
+                        if err != nil {
+                            replyFailure(event, id, "inspect new defects", err)
+                            return
+                        }
+                        if watermark == "" { // Never looked before
+                            query.window = defaultWindow
+                        }
+                        query, latest, err := unseenQuery(id, query)
+                        if err != nil {
+                            replyFailure(event, id, "inspect new defects", err)
+                            return
+                        }
+                        response, _, err := inspect(id, query)
+                        if err != nil {
+                            replyFailure(event, id, "inspect new defects", err)
+                            return
+                        }
+                        replyFlexMessage(event, `缺陷詳情`, response)
+                        if err = updateWatermark(id, latest); err != nil {
+                            log.Println(fmt.Sprintf(`Updating watermark of %s failed : "%s".`, id, err))
+                        }
+                        log.Println(fmt.Sprintf("User %s inspected new defects.", id))
+                        break
+                    }
+
+                    query, err := queryArguments(arguments)
+                    if err != nil {
+                        replyTextMessage(event, `命令格式不正確`)
+                        return
+                    }
+
+                    response, _, err := inspect(id, query)
+                    if err != nil {
+                        replyFailure(event, id, "inspect", err)
+                        return
+                    }
                     replyFlexMessage(event, `缺陷詳情`, response)
                     if contains(arguments, "all") {
                         log.Println(fmt.Sprintf("User %s inspected all types of defect.", id))
@@ -189,6 +219,112 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
                         log.Println(fmt.Sprintf("User %s inspected subscribed.", id))
                         break
                     }
+                case "search":
+                    arguments, err := argumentSplitter(commandParameters)
+                    if err != nil {
+                        replyTextMessage(event, "指令結尾不可為空白")
+                        return
+                    }
+
+                    if len(arguments) == 0 || !matchString(`^[^"\\%_]+$`, arguments[0]) {
+                        replyTextMessage(event, `命令格式不正確`)
+                        return
+                    }
+                    query, err := queryArguments(arguments[1:])
+                    if err != nil {
+                        replyTextMessage(event, `命令格式不正確`)
+                        return
+                    }
+                    query.keyword = arguments[0]
+                    if len(query.markids) == 0 { // Search all types unless specified
+                        query.markids = []string{"all"}
+                    }
+
+                    response, _, err := inspect(id, query)
+                    if err != nil {
+                        replyFailure(event, id, "search", err)
+                        return
+                    }
+                    replyFlexMessage(event, `搜尋結果`, response)
+                    log.Println(fmt.Sprintf("User %s searched %s.", id, strings.Join(arguments, " ")))
+                case "detail":
+                    arguments, err := argumentSplitter(commandParameters)
+                    if err != nil {
+                        replyTextMessage(event, "指令結尾不可為空白")
+                        return
+                    }
+
+                    if len(arguments) != 1 || !matchString(`^#?\d+$`, arguments[0]) {
+                        replyTextMessage(event, `命令格式不正確`)
+                        return
+                    }
+                    seq := strings.TrimPrefix(arguments[0], "#")
+
+                    response, _, err := detail(seq)
+                    if err != nil {
+                        replyFailure(event, id, "detail", err)
+                        return
+                    }
+                    replyFlexMessage(event, `缺陷 #`+seq, response)
+                    log.Println(fmt.Sprintf("User %s detailed %s.", id, seq))
+                case "trend":
+                    arguments, err := argumentSplitter(commandParameters)
+                    if err != nil {
+                        replyTextMessage(event, "指令結尾不可為空白")
+                        return
+                    }
+
+                    if os.Getenv("PublicURL") == "" {
+                        replyTextMessage(event, "尚未設定PublicURL，無法傳送圖表")
+                        return
+                    }
+                    query, err := queryArguments(arguments)
+                    if err != nil {
+                        replyTextMessage(event, `命令格式不正確`)
+                        return
+                    }
+                    period := false
+                    for _, argument := range arguments {
+                        period = period || parsePeriod(argument, &DefectQuery{})
+                    }
+                    if !period {
+                        query.window = defaultTrendWindow
+                    }
+
+                    buckets, unit, err := trend(id, query)
+                    if err == errTooManyBuckets {
+                        replyTextMessage(event, fmt.Sprintf("時間範圍過長，圖表最多%d個區間", maxTrendBuckets))
+                        return
+                    } else if err != nil {
+                        replyFailure(event, id, "chart", err)
+                        return
+                    }
+                    replyTrendMessage(event, formatTrend(query, buckets, unit), chartLink(id, query))
+                    log.Println(fmt.Sprintf("User %s charted %s.", id, strings.Join(arguments, " ")))
+                case "export":
+                    arguments, err := argumentSplitter(commandParameters)
+                    if err != nil {
+                        replyTextMessage(event, "指令結尾不可為空白")
+                        return
+                    }
+
+                    if os.Getenv("PublicURL") == "" {
+                        replyTextMessage(event, "尚未設定PublicURL，無法提供下載連結")
+                        return
+                    }
+                    format := "xlsx"
+                    if len(arguments) > 0 && (arguments[len(arguments)-1] == "csv" || arguments[len(arguments)-1] == "xlsx") {
+                        format = arguments[len(arguments)-1]
+                        arguments = arguments[:len(arguments)-1]
+                    }
+                    query, err := queryArguments(arguments)
+                    if err != nil {
+                        replyTextMessage(event, `命令格式不正確`)
+                        return
+                    }
+
+                    replyTextMessage(event, fmt.Sprintf("%s的缺陷資料下載連結，%s內有效：\n%s", formatPeriod(query), formatWindow(exportLinkTTL), exportLink(id, query, format)))
+                    log.Println(fmt.Sprintf("User %s exported %s.", id, strings.Join(arguments, " ")))
                 case "summary":
                     arguments, err := argumentSplitter(commandParameters)
                     if err != nil {
@@ -196,12 +332,19 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
                         return
                     }
 
-                    if response := summary(id, arguments); response != nil {
-                        replyFlexMessage(event, `缺陷彙整`, response)
-                    } else {
+                    query, err := queryArguments(arguments)
+                    if err != nil {
                         replyTextMessage(event, `命令格式不正確`)
+                        return
                     }
 
+                    response, err := summary(id, query)
+                    if err != nil {
+                        replyFailure(event, id, "summarize", err)
+                        return
+                    }
+                    replyFlexMessage(event, `缺陷彙整`, response)
+
                     if contains(arguments, "all") {
                         log.Println(fmt.Sprintf("User %s summarized all types of defect.", id))
                         break
@@ -218,167 +361,594 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
                 case "leave":
                     if first := string(id[0]); first == "C" {
                         log.Println("Group " + id + " wants bot to leave.")
-                        bot.LeaveGroup(id).Do()
+                        // Subscriptions are kept unless the bot is really gone
+                        if _, err := bot.LeaveGroup(id).Do(); err != nil {
+                            replyFailure(event, id, "leave", err)
+                            return
+                        }
+                        if err := removeChat(id); err != nil {
+                            log.Println(fmt.Sprintf(`Removing chat %s failed : "%s".`, id, err))
+                        }
                     } else if first == "R" {
                         log.Println("Room " + id + " wants bot to leave.")
-                        bot.LeaveRoom(id).Do()
+                        if _, err := bot.LeaveRoom(id).Do(); err != nil {
+                            replyFailure(event, id, "leave", err)
+                            return
+                        }
+                        if err := removeChat(id); err != nil {
+                            log.Println(fmt.Sprintf(`Removing chat %s failed : "%s".`, id, err))
+                        }
                     } else {
                         replyTextMessage(event, "一對一聊天無法離開")
                     }
+                case "schedule":
+                    arguments, err := argumentSplitter(commandParameters)
+                    if err != nil {
+                        replyTextMessage(event, "指令結尾不可為空白")
+                        return
+                    }
+
+                    if len(arguments) == 0 {
+                        replyTextMessage(event, "命令格式不正確")
+                        return
+                    }
+                    switch arguments[0] {
+                    case "set":
+                        var specs []string
+                        for _, spec := range strings.Split(strings.Join(arguments[1:], " "), ";") {
+                            if spec = strings.TrimSpace(spec); spec != "" {
+                                specs = append(specs, spec)
+                            }
+                        }
+                        if err := validSchedule(specs); err == errScheduleTooFrequent {
+                            replyTextMessage(event, fmt.Sprintf("排程間隔不可少於%s", formatWindow(minScheduleInterval)))
+                            return
+                        } else if err != nil {
+                            replyTextMessage(event, "排程格式不正確，格式為：分 時 日 月 星期")
+                            return
+                        }
+                        if err := setSchedule(id, specs); err != nil {
+                            replyFailure(event, id, "set schedule", err)
+                            return
+                        }
+                        response, err := replySchedule(id)
+                        if err != nil {
+                            replyFailure(event, id, "list schedule", err)
+                            return
+                        }
+                        replyTextMessage(event, "設定排程成功\n\n"+response)
+                        log.Println(fmt.Sprintf("User %s set schedule %s.", id, strings.Join(specs, ";")))
+                    case "list":
+                        response, err := replySchedule(id)
+                        if err != nil {
+                            replyFailure(event, id, "list schedule", err)
+                            return
+                        }
+                        replyTextMessage(event, response)
+                        log.Println(fmt.Sprintf("User %s listed schedule.", id))
+                    case "clear":
+                        if err := clearSchedule(id); err != nil {
+                            replyFailure(event, id, "clear schedule", err)
+                            return
+                        }
+                        response, err := replySchedule(id)
+                        if err != nil {
+                            replyFailure(event, id, "list schedule", err)
+                            return
+                        }
+                        replyTextMessage(event, "清除排程成功\n\n"+response)
+                        log.Println(fmt.Sprintf("User %s cleared schedule.", id))
+                    default:
+                        replyTextMessage(event, "命令格式不正確")
+                    }
                 case "getid":
                     replyTextMessage(event, id)
+                case "quarantine":
+                    if !isAdmin(id) {
+                        replyTextMessage(event, "未知的命令，輸入help查看指令幫助")
+                        return
+                    }
+
+                    arguments, err := argumentSplitter(commandParameters)
+                    if err != nil {
+                        replyTextMessage(event, "指令結尾不可為空白")
+                        return
+                    }
+
+                    if len(arguments) == 1 && arguments[0] == "list" {
+                        response, err := replyQuarantined()
+                        if err != nil {
+                            replyFailure(event, id, "list quarantined chats", err)
+                            return
+                        }
+                        replyTextMessage(event, response)
+                        log.Println(fmt.Sprintf("Admin %s listed quarantined chats.", id))
+                    } else if len(arguments) >= 2 && arguments[0] == "restore" {
+                        restored, err := restoreQuarantined(arguments[1:])
+                        if err != nil {
+                            replyFailure(event, id, "restore quarantined chats", err)
+                            return
+                        }
+                        replyTextMessage(event, fmt.Sprintf("已恢復%d個對話", restored))
+                        log.Println(fmt.Sprintf("Admin %s restored %s.", id, strings.Join(arguments[1:], " ")))
+                    } else {
+                        replyTextMessage(event, _adminHelp)
+                    }
                 case "version":
                     replyTextMessage(event, _version)
                 default:
                     replyTextMessage(event, "未知的命令，輸入help查看指令幫助")
                 }
+            case *linebot.LocationMessage:
+                id, ok := sourceID(event)
+                if !ok {
+                    replyTextMessage(event, "不支援的對話類型")
+                    return
+                }
+
+                response, _, err := nearby(message.Latitude, message.Longitude)
+                if err != nil {
+                    replyFailure(event, id, "inspect nearby defects", err)
+                    return
+                }
+                replyFlexMessage(event, `附近缺陷`, response)
+                log.Println(fmt.Sprintf("User %s inspected defects near %f,%f.", id, message.Latitude, message.Longitude))
             default:
                 replyTextMessage(event, "未知的命令，輸入help查看指令幫助")
             }
+        } else if event.Type == linebot.EventTypePostback {
+            postbackHandler(event)
+        } else if event.Type == linebot.EventTypeFollow || event.Type == linebot.EventTypeJoin {
+            welcomeHandler(event)
+        } else if event.Type == linebot.EventTypeUnfollow || event.Type == linebot.EventTypeLeave {
+            farewellHandler(event)
         }
     }
 }
 
+func welcomeHandler(event *linebot.Event) {
+    id, ok := sourceID(event)
+    if !ok {
+        return
+    }
+
+    quickstart := linebot.NewTextMessage(_quickstart)
+    if quickReplies, err := subscribeQuickReplies(id, 0); err != nil {
+        log.Println(fmt.Sprintf(`Loading subscriptions of %s failed : "%s".`, id, err))
+    } else {
+        quickstart.WithQuickReplies(quickReplies)
+    }
+    if _, err := bot.ReplyMessage(event.ReplyToken, linebot.NewTextMessage(_welcome+"\n\n"+_help), quickstart).Do(); err != nil {
+        log.Println(err)
+    }
+    log.Println(fmt.Sprintf("Chat %s started using bot.", id))
+}
+
+func farewellHandler(event *linebot.Event) {
+    id, ok := sourceID(event)
+    if !ok {
+        return
+    }
+
+    if err := removeChat(id); err != nil {
+        log.Println(fmt.Sprintf(`Removing chat %s failed : "%s".`, id, err))
+        return
+    }
+    log.Println(fmt.Sprintf("Chat %s stopped using bot, removed its subscriptions.", id))
+}
+
+func postbackHandler(event *linebot.Event) {
+    id, ok := sourceID(event)
+    if !ok {
+        replyTextMessage(event, "不支援的對話類型")
+        return
+    }
+
+    data, err := url.ParseQuery(event.Postback.Data)
+    if err != nil {
+        replyTextMessage(event, "命令格式不正確")
+        return
+    }
+
+    var arguments []string
+    if defects := data.Get("defects"); defects != "" {
+        arguments = strings.Split(defects, ".")
+    } else {
+        arguments = []string{}
+    }
+
+    switch data.Get("action") {
+    case "sub":
+        subscribe(event, id, arguments)
+    case "unsub":
+        unsubscribe(event, id, arguments)
+    case "list":
+        offset, err := strconv.Atoi(data.Get("offset"))
+        if err != nil || offset < 0 {
+            offset = 0
+        }
+        response, err := replyAllSubscribe(id)
+        if err != nil {
+            replyFailure(event, id, "list", err)
+            return
+        }
+        replySubscribeMessage(event, id, response, offset)
+        log.Println(fmt.Sprintf("User %s listed.", id))
+    case "inspect":
+        query, err := decodeQuery(data)
+        if err != nil {
+            replyTextMessage(event, "命令格式不正確")
+            return
+        }
+
+        response, _, err := inspect(id, query)
+        if err != nil {
+            replyFailure(event, id, "inspect", err)
+            return
+        }
+        replyFlexMessage(event, `缺陷詳情`, response)
+        log.Println(fmt.Sprintf("User %s inspected page %d.", id, query.page))
+    case "detail":
+        seq := data.Get("seq")
+        if !matchString(`^\d+$`, seq) {
+            replyTextMessage(event, "命令格式不正確")
+            return
+        }
+
+        response, _, err := detail(seq)
+        if err != nil {
+            replyFailure(event, id, "detail", err)
+            return
+        }
+        replyFlexMessage(event, `缺陷 #`+seq, response)
+        log.Println(fmt.Sprintf("User %s detailed %s.", id, seq))
+    default:
+        replyTextMessage(event, "未知的命令，輸入help查看指令幫助")
+    }
+}
+
+func subscribe(event *linebot.Event, id string, arguments []string) {
+    arguments, area, err := areaArguments(arguments)
+    if err != nil {
+        replyTextMessage(event, "區域格式不正確")
+        return
+    }
+
+    // Replacing the area silently would move the other subscriptions too
+    if area != nil {
+        current, err := checkGeofence(id, area)
+        if err == errAreaConflict {
+            replyTextMessage(event, "此對話已訂閱區域"+current.describe()+"，區域套用於所有訂閱，每個對話只能有一個區域\n若要更換區域請先輸入unsub area")
+            return
+        } else if err != nil {
+            replyFailure(event, id, "subscribe", err)
+            return
+        }
+    }
+
+    result, err := addSubscriber(id, arguments)
+    if err == nil && area != nil && result != 3 {
+        err = setGeofence(id, area)
+    }
+    if err != nil {
+        replyFailure(event, id, "subscribe", err)
+        return
+    }
+    if result == 3 {
+        replyTextMessage(event, "命令格式不正確")
+        return
+    }
+
+    subscribing, err := replyAllSubscribe(id)
+    if err != nil {
+        replyFailure(event, id, "list", err)
+        return
+    }
+    var response string
+    switch result {
+    case 0:
+        response = "訂閱缺陷種類" + strings.Join(arguments, " ") + "成功\n\n" + subscribing
+    case 1:
+        response = "訂閱全部缺陷種類成功\n\n" + subscribing
+    case 2:
+        if area != nil { // Only the area is new
+            response = subscribing
+        } else {
+            response = "已經訂閱所有種類，此命令將被忽略\n若要取消訂閱所有種類請輸入unsub\n\n" + subscribing
+        }
+    }
+    if area != nil {
+        response = "訂閱區域" + area.describe() + "成功，區域套用於所有訂閱\n" + response
+    }
+
+    replySubscribeMessage(event, id, response, 0)
+    if len(arguments) == 0 {
+        arguments = []string{"all"}
+    }
+    log.Println(fmt.Sprintf("User %s subscribing %s.", id, strings.Join(arguments, " ")))
+    if area != nil {
+        log.Println(fmt.Sprintf("User %s subscribing area %s.", id, area.describe()))
+    }
+}
+
+func unsubscribe(event *linebot.Event, id string, arguments []string) {
+    if len(arguments) == 1 && arguments[0] == "area" {
+        if err := removeGeofence(id); err != nil {
+            replyFailure(event, id, "unsubscribe area", err)
+            return
+        }
+        subscribing, err := replyAllSubscribe(id)
+        if err != nil {
+            replyFailure(event, id, "list", err)
+            return
+        }
+        replySubscribeMessage(event, id, "取消訂閱區域成功\n\n"+subscribing, 0)
+        log.Println(fmt.Sprintf("User %s quit subscribing area.", id))
+        return
+    }
+
+    result, err := removeSubscriber(id, arguments)
+    if err != nil {
+        replyFailure(event, id, "unsubscribe", err)
+        return
+    }
+    if result == 3 {
+        replyTextMessage(event, "命令格式不正確")
+        return
+    }
+
+    subscribing, err := replyAllSubscribe(id)
+    if err != nil {
+        replyFailure(event, id, "list", err)
+        return
+    }
+    var response string
+    switch result {
+    case 0:
+        response = "取消訂閱缺陷種類" + strings.Join(arguments, " ") + "成功\n\n" + subscribing
+    case 1:
+        response = "取消訂閱全部缺陷種類成功\n\n" + subscribing
+    case 2:
+        response = "移除所有訂閱成功\n\n" + subscribing
+    }
+
+    replySubscribeMessage(event, id, response, 0)
+    if contains(arguments, "all") {
+        arguments = []string{"all item"}
+    }
+    if len(arguments) == 0 {
+        arguments = []string{"all"}
+    }
+    log.Println(fmt.Sprintf("User %s quit subscribing %s.", id, strings.Join(arguments, " ")))
+}
+
 func triggerHandler(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     id := vars["id"]
     defects := vars["defects"]
-    if !matchString(`^(U|R|C)(\w{32})$`, id) || (!matchString(`^(all|D\d{2})(.(all|D\d{2}))*$`, defects) && defects != "") {
+    if !validTarget(id) || (!matchString(`^(all|D\d{2})(.(all|D\d{2}))*$`, defects) && defects != "") {
         fmt.Fprintf(w, "Format unaccepted.")
         return
     }
+    key, ok := requestKey(r)
+    if !ok || !key.allows(scopeTrigger) {
+        w.WriteHeader(http.StatusUnauthorized)
+        fmt.Fprintf(w, "Unauthorized.")
+        return
+    }
+    if !key.canPush(id) {
+        w.WriteHeader(http.StatusForbidden)
+        fmt.Fprintf(w, "Forbidden to push to this ID.")
+        return
+    }
 
     var args []string
     if defects != "" {
         args = strings.Split(defects, ".")
     }
 
+    query := DefectQuery{markids: args, window: defaultWindow, page: 1}
+    if period := r.URL.Query().Get("period"); period != "" && !parsePeriod(period, &query) {
+        fmt.Fprintf(w, "Format unaccepted.")
+        return
+    }
+
     var err error
-    response, _ := inspect(id, args)
-    if _, err = bot.PushMessage(id, linebot.NewFlexMessage("缺陷詳情", response)).Do(); err != nil {
-        log.Println(err)
+    if _, err = notify(id, Report{title: "缺陷詳情", query: query}, false); err != nil {
+        log.Println(fmt.Sprintf(`Triggered push to %s failed : "%s".`, id, err))
+        w.WriteHeader(http.StatusBadGateway)
+        fmt.Fprintf(w, "Request failed.")
+        return
     }
 
     fmt.Fprintf(w, "Request success.")
 }
 
 func addSubscriber(id string, arguments []string) (int, error) {
+    /*
+       int : 0 subscribed the types, 1 subscribed all, 2 already subscribing all, 3 format unaccepted
+    */
+
     for _, argument := range arguments {
         if !matchString(`^(D\d{2})$`, argument) {
-            return 3, errors.New("")
+            return 3, nil
         }
     }
 
-    tx, _ := db.Begin()
-
-    stmt, err := tx.Prepare("select count(*) from subscriber where `id` = ? and `subscribe` = 'all'")
-    checkError(err)
+    tx, err := db.Begin()
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
 
     var all int
-    err = stmt.QueryRow(id).Scan(&all)
-    checkError(err)
-
+    if err = tx.QueryRow("select count(*) from subscriber where `id` = ? and `subscribe` = 'all'", id).Scan(&all); err != nil {
+        return 0, err
+    }
     if all == 1 {
-        err := tx.Commit()
-        checkError(err)
         return 2, nil
     }
 
     if len(arguments) >= 1 {
-        stmt, _ := tx.Prepare("insert into subscriber (`id`, `subscribe`) values (?, ?)")
         for _, argument := range arguments {
-            if argument == "all" {
-                return 3, nil
+            if _, err = tx.Exec("insert or ignore into subscriber (`id`, `subscribe`) values (?, ?)", id, argument); err != nil {
+                return 0, err
             }
-            stmt.Exec(id, argument)
         }
-        err = tx.Commit()
-        checkError(err)
-
-        return 0, nil
+        return 0, tx.Commit()
     } else {
-        stmt, _ := tx.Prepare("insert into subscriber (`id`, `subscribe`) values (?, 'all')")
-        stmt.Exec(id)
-        err := tx.Commit()
-        checkError(err)
-
-        return 1, nil
+        if _, err = tx.Exec("insert or ignore into subscriber (`id`, `subscribe`) values (?, 'all')", id); err != nil {
+            return 0, err
+        }
+        return 1, tx.Commit()
     }
 }
 
 func removeSubscriber(id string, arguments []string) (int, error) {
+    /*
+       int : 0 unsubscribed the types, 1 unsubscribed all, 2 removed everything, 3 format unaccepted
+    */
+
     for _, argument := range arguments {
         if !matchString(`^D\d{2}|all$`, argument) {
-            return 3, errors.New("")
+            return 3, nil
         }
     }
 
-    tx, _ := db.Begin()
     if contains(arguments, "all") {
-        stmt, _ := tx.Prepare("delete from subscriber where id = ?")
-        stmt.Exec(id)
-        err := tx.Commit()
-        checkError(err)
+        if _, err := db.Exec("delete from subscriber where id = ?", id); err != nil {
+            return 2, err
+        }
+        // Nothing left to push, so the chat's own schedule goes too
+        return 2, clearSchedule(id)
+    }
+    if len(arguments) >= 1 {
+        tx, err := db.Begin()
+        if err != nil {
+            return 0, err
+        }
+        defer tx.Rollback()
+        for _, argument := range arguments {
+            if _, err = tx.Exec("delete from subscriber where id = ? and subscribe = ?", id, argument); err != nil {
+                return 0, err
+            }
+        }
+        return 0, tx.Commit()
+    } else {
+        _, err := db.Exec("delete from subscriber where id = ? and subscribe = 'all'", id)
+        return 1, err
+    }
+}
+
+func removeChat(id string) error {
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    for _, table := range []string{"subscriber", "delivery", "watermark", "geofence"} {
+        if _, err = tx.Exec("delete from "+table+" where id = ?", id); err != nil {
+            return err
+        }
+    }
+    if err = tx.Commit(); err != nil {
+        return err
+    }
+
+    return clearSchedule(id)
+}
+
+func replyAllSubscribe(id string) (string, error) {
+    all, subscribes, err := retriveSubscribe(id)
+    if err != nil {
+        return "", err
+    }
+    if !all && len(subscribes) == 0 {
+        return "您目前沒有任何訂閱", nil
+    }
+
+    var areaText string
+    area, err := retriveGeofence(id)
+    if err != nil {
+        return "", err
+    }
+    if area != nil {
+        areaText = "\n\n訂閱區域（套用於所有訂閱及調閱）：\n" + area.describe()
+    }
 
-        return 2, nil
+    if all {
+        return "您目前訂閱了：\n全部" + areaText, nil
     }
-    if len(arguments) >= 1 {
-        stmt, _ := tx.Prepare("delete from subscriber where id = ? and subscribe = ?")
-        for _, argument := range arguments {
-            stmt.Exec(id, argument)
-        }
-        err := tx.Commit()
-        checkError(err)
+    return "您目前訂閱了：\n" + strings.Join(subscribes, "\n") + areaText, nil
+}
 
-        return 0, nil
-    } else {
-        stmt, _ := tx.Prepare("delete from subscriber where id = ? and subscribe = 'all'")
-        stmt.Exec(id)
-        err := tx.Commit()
-        checkError(err)
+func retriveSubscribe(id string) (bool, []string, error) {
+    rows, err := db.Query("select subscribe from subscriber where `id` = ?", id)
+    if err != nil {
+        return false, nil, err
+    }
+    defer rows.Close()
 
-        return 1, nil
+    subscribes := []string{}
+    for rows.Next() {
+        var subscribe string
+        if err = rows.Scan(&subscribe); err != nil {
+            return false, nil, err
+        }
+        if subscribe == "all" {
+            return true, []string{}, nil
+        }
+        subscribes = append(subscribes, subscribe)
     }
-}
 
-func replyAllSubscribe(id string) string {
-    tx, _ := db.Begin()
+    return false, subscribes, rows.Err()
+}
 
-    var all int
-    err := tx.QueryRow("select count(*) from subscriber where `id` = ? and `subscribe` = 'all'", id).Scan(&all)
-    checkError(err)
-    if all == 1 {
-        tx.Commit()
-        return "您目前訂閱了：\n全部"
+func subscribeQuickReplies(id string, offset int) (*linebot.QuickReplyItems, error) {
+    all, subscribes, err := retriveSubscribe(id)
+    if err != nil {
+        return nil, err
+    }
+    if all {
+        return linebot.NewQuickReplyItems(
+            linebot.NewQuickReplyButton("", linebot.NewPostbackAction("取消訂閱全部", "action=unsub", "", "unsub")),
+        ), nil
     }
 
-    subscribing, err := tx.Query("select subscribe from subscriber where `id` = ?", id)
-    checkError(err)
-    response := "您目前訂閱了："
-    rowNums := 0
-    defer subscribing.Close()
-    for subscribing.Next() {
-        var subscribe string
-        subscribing.Scan(&subscribe)
-        response += "\n" + subscribe
-        rowNums += 1
+    var buttons []*linebot.QuickReplyButton
+    if offset == 0 {
+        buttons = append(buttons, linebot.NewQuickReplyButton("", linebot.NewPostbackAction("訂閱全部", "action=sub", "", "sub")))
     }
-    if rowNums == 0 {
-        response = "您目前沒有任何訂閱"
+
+    markids := defectMarkids()
+    for i := offset; i < len(markids); i++ {
+        if len(buttons) == maxQuickReplies-1 && i < len(markids)-1 {
+            buttons = append(buttons, linebot.NewQuickReplyButton("", linebot.NewPostbackAction("更多", fmt.Sprintf("action=list&offset=%d", i), "", "更多")))
+            break
+        }
+        markid := markids[i]
+        if contains(subscribes, markid) {
+            buttons = append(buttons, linebot.NewQuickReplyButton("", linebot.NewPostbackAction(quickReplyLabel("取消", markid), "action=unsub&defects="+markid, "", "unsub "+markid)))
+        } else {
+            buttons = append(buttons, linebot.NewQuickReplyButton("", linebot.NewPostbackAction(quickReplyLabel("訂閱", markid), "action=sub&defects="+markid, "", "sub "+markid)))
+        }
     }
 
-    tx.Commit()
-    return response
+    return linebot.NewQuickReplyItems(buttons...), nil
 }
 
-func inspect(id string, arguments []string) (linebot.FlexContainer, bool) {
-    // Check integrity of arguments
-    for _, argument := range arguments {
-        if !matchString(`^D\d{2}|all$`, argument) {
-            return nil, false
-        }
+func quickReplyLabel(verb string, markid string) string {
+    label := []rune(verb + " " + markid)
+    if defectName(markid) != "" {
+        label = []rune(verb + " " + defectName(markid))
+    }
+    if len(label) > 20 { // Label is limited to 20 characters
+        label = label[:20]
     }
+    return string(label)
+}
 
+func inspect(id string, query DefectQuery) (linebot.FlexContainer, bool, error) {
     // Initial empty flexbox for line
     flexJson := []byte(`{"type":"carousel","contents":[]}`)
     var flex interface{}
@@ -386,25 +956,43 @@ func inspect(id string, arguments []string) (linebot.FlexContainer, bool) {
 
     t := time.Now()
 
-    defectDetails := retriveDefectDetail(id, arguments)
-    defects := retriveDefectNum(id, arguments)
+    defectDetails, err := retriveDefectDetail(id, query)
+    if err != nil {
+        return nil, false, err
+    }
+    defects, err := retriveDefectNum(id, query)
+    if err != nil {
+        return nil, false, err
+    }
+    hasNext := len(defectDetails) > pageSize
+    if hasNext {
+        defectDetails = defectDetails[:pageSize]
+    }
     if len(defectDetails) == 0 {
         // Item insert to flexbox
-        listItemJson := []byte(fmt.Sprintf(`{"type":"bubble","size":"kilo","body":{"type":"box","layout":"vertical","contents":[{"type":"text","text":"生成時間 %s","color":"#aaaaaa","size":"sm"},{"type":"text","text":"過去80分鐘內","size":"xl"},{"type":"text","text":"沒有新增任何資料","size":"xl"}],"alignItems":"center","justifyContent":"center"}}`, t.Format("2006-01-02 15:04:05")))
+        listItemJson := []byte(fmt.Sprintf(`{"type":"bubble","size":"kilo","body":{"type":"box","layout":"vertical","contents":[{"type":"text","text":"生成時間 %s","color":"#aaaaaa","size":"sm"},{"type":"text","text":"%s","size":"xl","wrap":true,"align":"center"},{"type":"text","text":"沒有新增任何資料","size":"xl"}],"alignItems":"center","justifyContent":"center"}}`, t.Format("2006-01-02 15:04:05"), escapeJSON(formatCondition(query))))
         var listItem interface{}
         json.Unmarshal(listItemJson, &listItem)
         dyno.Append(flex, listItem, "contents")
     } else {
         // Summary
-        summaryJson := []byte(fmt.Sprintf(`{"type":"bubble","size":"kilo","body":{"type":"box","layout":"vertical","contents":[{"type":"text","text":"彙整","weight":"bold","size":"xxl","margin":"md"},{"type":"box","layout":"horizontal","contents":[{"type":"text","text":"生成時間","size":"sm","color":"#aaaaaa","flex":0,"margin":"none"},{"type":"text","text":"%s","size":"xs","color":"#aaaaaa","offsetStart":"md"}]},{"type":"separator","margin":"xxl"},{"type":"box","layout":"vertical","margin":"lg","spacing":"sm","contents":[]}]},"footer":{"type":"box","layout":"baseline","contents":[{"type":"text","text":"*過去80分鐘內","align":"end","size":"xs","color":"#aaaaaa"}]},"styles":{"footer":{"separator":true}}}`, t.Format("2006-01-02 15:04:05")))
+        total := 0
+        for _, defect := range defects {
+            total += defect.num
+        }
+        var pageLabel string
+        if pages := (total + pageSize - 1) / pageSize; pages > 1 {
+            pageLabel = fmt.Sprintf(` 第%d/%d頁`, query.page, pages)
+        }
+        summaryJson := []byte(fmt.Sprintf(`{"type":"bubble","size":"kilo","body":{"type":"box","layout":"vertical","contents":[{"type":"text","text":"彙整","weight":"bold","size":"xxl","margin":"md"},{"type":"box","layout":"horizontal","contents":[{"type":"text","text":"生成時間","size":"sm","color":"#aaaaaa","flex":0,"margin":"none"},{"type":"text","text":"%s","size":"xs","color":"#aaaaaa","offsetStart":"md"}]},{"type":"separator","margin":"xxl"},{"type":"box","layout":"vertical","margin":"lg","spacing":"sm","contents":[]}]},"footer":{"type":"box","layout":"baseline","contents":[{"type":"text","text":"*%s%s","align":"end","size":"xs","color":"#aaaaaa","wrap":true}]},"styles":{"footer":{"separator":true}}}`, t.Format("2006-01-02 15:04:05"), escapeJSON(formatCondition(query)), pageLabel))
         var summaryTemplate interface{}
         json.Unmarshal(summaryJson, &summaryTemplate)
         for _, defect := range defects {
             var listItemJson []byte
-            if defectnames[defect.markid] == "" {
+            if defectName(defect.markid) == "" {
                 listItemJson = []byte(fmt.Sprintf(`{"type":"box","layout":"horizontal","contents":[{"type":"text","text":"%s","size":"sm","color":"#555555","flex":0},{"type":"text","text":"%s筆","size":"sm","color":"#111111","align":"end"}]}`, defect.markid, strconv.Itoa(defect.num)))
             } else {
-                listItemJson = []byte(fmt.Sprintf(`{"type":"box","layout":"horizontal","contents":[{"type":"text","text":"%s(%s)","size":"sm","color":"#555555","flex":0},{"type":"text","text":"%s筆","size":"sm","color":"#111111","align":"end"}]}`, defectnames[defect.markid], defect.markid, strconv.Itoa(defect.num)))
+                listItemJson = []byte(fmt.Sprintf(`{"type":"box","layout":"horizontal","contents":[{"type":"text","text":"%s(%s)","size":"sm","color":"#555555","flex":0},{"type":"text","text":"%s筆","size":"sm","color":"#111111","align":"end"}]}`, escapeJSON(defectName(defect.markid)), defect.markid, strconv.Itoa(defect.num)))
             }
             var listItem interface{}
             json.Unmarshal(listItemJson, &listItem)
@@ -414,120 +1002,112 @@ func inspect(id string, arguments []string) (linebot.FlexContainer, bool) {
 
         // Detail
         for _, defectDetail := range defectDetails {
-            var listItemJson []byte
-            var defectTypeName string
-            if defectnames[defectDetail.markid] == "" {
-                defectTypeName = defectDetail.markid
-            } else {
-                defectTypeName = defectnames[defectDetail.markid] + `(` + defectDetail.markid + `)`
-            }
-            photoPreviewUri := fmt.Sprintf(`https://%s/v1/get/img/%s/previews/%s`, os.Getenv("ImageAPIHost"), strings.Replace(defectDetail.markdate, "-", "", -1), defectDetail.photo)
-            photoUri := fmt.Sprintf(`https://%s/v1/get/img/%s/originals/%s`, os.Getenv("ImageAPIHost"), strings.Replace(defectDetail.markdate, "-", "", -1), defectDetail.photo)
-            gps := fmt.Sprintf(`%s,%s`, defectDetail.gps_y, defectDetail.gps_x)
-            var address string
-            if defectDetail.address != "" {
-                address = defectDetail.address
-            } else {
-                address = `資料庫內沒有地址`
-            }
+            dyno.Append(flex, detailBubble(defectDetail), "contents")
+        }
 
-            // Item insert to flexbox
-            listItemJson = []byte(fmt.Sprintf(`{"type":"bubble","size":"kilo","hero":{"type":"box","layout":"vertical","contents":[{"type":"image","url":"%s","size":"full","aspectMode":"cover","aspectRatio":"16:9","action":{"type":"uri","label":"action","uri":"%s"}},{"type":"image","url":"https://dev.virtualearth.net/REST/V1/Imagery/Map/Road/%s/18?mapSize=800,450&format=jpeg&pushpin=%s;90;&key=AmkZpObWs0kj2Yu2XYjj85i3qz_JZYzXQ_W26LYkFJtPY0Hw029eIWEJivjhGx0E","size":"full","aspectMode":"cover","aspectRatio":"16:9","action":{"type":"uri","label":"action","uri":"http://www.google.com/maps/place/%s"}}]},"body":{"type":"box","layout":"vertical","contents":[{"type":"box","layout":"horizontal","contents":[{"type":"text","text":"%s","weight":"bold","size":"lg","wrap":true},{"type":"text","text":"%s %s","color":"#aaaaaa","size":"sm","align":"end","flex":0}],"alignItems":"center"},{"type":"box","layout":"baseline","contents":[{"type":"icon","size":"xs","url":"https://akveo.github.io/eva-icons/outline/png/128/hash-outline.png"},{"type":"text","text":"%s","size":"md","color":"#8c8c8c","flex":0,"margin":"sm"}],"alignItems":"center"},{"type":"box","layout":"baseline","contents":[{"type":"icon","size":"xs","url":"https://akveo.github.io/eva-icons/outline/png/128/pin-outline.png"},{"type":"text","text":"%s","size":"md","color":"#8c8c8c","flex":0,"margin":"sm"}],"alignItems":"center","action":{"type":"uri","label":"action","uri":"http://www.google.com/maps/place/%s"}},{"type":"box","layout":"vertical","contents":[{"type":"box","layout":"baseline","spacing":"sm","contents":[{"type":"icon","size":"xs","url":"https://akveo.github.io/eva-icons/outline/png/128/map-outline.png"},{"type":"text","text":"%s","wrap":true,"color":"#8c8c8c","size":"md","flex":5}]}]}],"spacing":"sm","paddingAll":"13px"}}`, photoPreviewUri, photoUri, gps, gps, gps, defectTypeName, defectDetail.markdate, defectDetail.marktime, defectDetail.seq_id, gps, gps, address))
-            var listItem interface{}
-            json.Unmarshal(listItemJson, &listItem)
-            dyno.Append(flex, listItem, "contents")
+        // Next Page
+        if hasNext {
+            last := defectDetails[len(defectDetails)-1]
+            next := query
+            next.page = query.page + 1
+            next.cursor = last.markdate + " " + last.marktime + "_" + last.seq_id
+            data := encodeQuery(next)
+            data.Set("action", "inspect")
+            var footerJson []byte
+            if len(data.Encode()) <= maxPostbackData {
+                footerJson = []byte(fmt.Sprintf(`{"type":"box","layout":"vertical","contents":[{"type":"button","action":{"type":"postback","label":"下一頁","data":"%s","displayText":"下一頁"},"style":"link","height":"sm"}]}`, data.Encode()))
+            } else { // LINE rejects the whole reply if the button carries too much
+                footerJson = []byte(fmt.Sprintf(`{"type":"box","layout":"vertical","contents":[{"type":"text","text":"條件過長，請於原指令後加上 page %d 查看下一頁","size":"xs","color":"#aaaaaa","wrap":true}]}`, next.page))
+            }
+            var footer interface{}
+            json.Unmarshal(footerJson, &footer)
+            dyno.Set(flex, footer, "contents", len(defectDetails), "footer")
         }
     }
 
     // Interface to line flex struct
     flexResult, _ := json.Marshal(flex)
-    container, _ := linebot.UnmarshalFlexMessageJSON(flexResult)
+    container, err := linebot.UnmarshalFlexMessageJSON(flexResult)
+    if err != nil {
+        return nil, false, err
+    }
 
-    return container, !(len(defectDetails) == 0)
+    return container, !(len(defectDetails) == 0), nil
 }
 
-func retriveDefectDetail(id string, arguments []string) []DefectDetail {
-    tx, _ := db.Begin()
-    rtx, _ := rdb.Begin()
-    defer func() {
-        tx.Commit()
-        rtx.Commit()
-    }()
+func detailBubble(defectDetail DefectDetail) interface{} {
+    var listItemJson []byte
+    var defectTypeName string
+    if defectName(defectDetail.markid) == "" {
+        defectTypeName = defectDetail.markid
+    } else {
+        defectTypeName = defectName(defectDetail.markid) + `(` + defectDetail.markid + `)`
+    }
+    photoPreviewUri, photoUri := photoURIs(defectDetail)
+    gps := fmt.Sprintf(`%s,%s`, defectDetail.gps_y, defectDetail.gps_x)
+    var address string
+    if defectDetail.address != "" {
+        address = defectDetail.address
+    } else {
+        address = `資料庫內沒有地址`
+    }
 
-    var stmt *sql.Stmt
-    var rows *sql.Rows
-    var err error
+    // Item insert to flexbox
+    listItemJson = []byte(fmt.Sprintf(`{"type":"bubble","size":"kilo","hero":{"type":"box","layout":"vertical","contents":[{"type":"image","url":"%s","size":"full","aspectMode":"cover","aspectRatio":"16:9","action":{"type":"uri","label":"action","uri":"%s"}},{"type":"image","url":"https://dev.virtualearth.net/REST/V1/Imagery/Map/Road/%s/18?mapSize=800,450&format=jpeg&pushpin=%s;90;&key=AmkZpObWs0kj2Yu2XYjj85i3qz_JZYzXQ_W26LYkFJtPY0Hw029eIWEJivjhGx0E","size":"full","aspectMode":"cover","aspectRatio":"16:9","action":{"type":"uri","label":"action","uri":"http://www.google.com/maps/place/%s"}}]},"body":{"type":"box","layout":"vertical","contents":[{"type":"box","layout":"horizontal","contents":[{"type":"text","text":"%s","weight":"bold","size":"lg","wrap":true},{"type":"text","text":"%s %s","color":"#aaaaaa","size":"sm","align":"end","flex":0}],"alignItems":"center"},{"type":"box","layout":"baseline","contents":[{"type":"icon","size":"xs","url":"https://akveo.github.io/eva-icons/outline/png/128/hash-outline.png"},{"type":"text","text":"%s","size":"md","color":"#8c8c8c","flex":0,"margin":"sm"}],"alignItems":"center","action":{"type":"postback","label":"action","data":"action=detail&seq=%s","displayText":"detail %s"}},{"type":"box","layout":"baseline","contents":[{"type":"icon","size":"xs","url":"https://akveo.github.io/eva-icons/outline/png/128/pin-outline.png"},{"type":"text","text":"%s","size":"md","color":"#8c8c8c","flex":0,"margin":"sm"}],"alignItems":"center","action":{"type":"uri","label":"action","uri":"http://www.google.com/maps/place/%s"}},{"type":"box","layout":"vertical","contents":[{"type":"box","layout":"baseline","spacing":"sm","contents":[{"type":"icon","size":"xs","url":"https://akveo.github.io/eva-icons/outline/png/128/map-outline.png"},{"type":"text","text":"%s","wrap":true,"color":"#8c8c8c","size":"md","flex":5}]}]}],"spacing":"sm","paddingAll":"13px"}}`, photoPreviewUri, photoUri, gps, gps, gps, escapeJSON(defectTypeName), defectDetail.markdate, defectDetail.marktime, defectDetail.seq_id, defectDetail.seq_id, defectDetail.seq_id, gps, gps, escapeJSON(address)))
+    var listItem interface{}
+    json.Unmarshal(listItemJson, &listItem)
 
-    if contains(arguments, "all") { // Retrive All Types
-        stmt, _ = rtx.Prepare("select seq_id, markid, markdate, marktime, GPS_y, GPS_x, addr, photo_loc from recv where timestamp(markdate, marktime) between convert_tz(date_sub(now(), interval 80 minute), 'system', '+08:00') and convert_tz(now(), 'system', '+08:00') order by marktime desc, seq_id limit 11")
-        rows, err = stmt.Query()
-    } else if len(arguments) >= 1 { // Retrive Specific Types
-        args := make([]interface{}, len(arguments))
-        for i, argument := range arguments {
-            args[i] = argument
-        }
-        stmt, _ = rtx.Prepare(`select seq_id, markid, markdate, marktime, GPS_y, GPS_x, addr, photo_loc from recv where timestamp(markdate, marktime) between convert_tz(date_sub(now(), interval 80 minute), 'system', '+08:00') and convert_tz(now(), 'system', '+08:00') and markid in (?` + strings.Repeat(",?", len(args)-1) + `) order by marktime desc, seq_id limit 11`)
-        rows, err = stmt.Query(args...)
-    } else { // Retrive Subscribed Types
-        var all int
-        tx.QueryRow("select count(*) from subscriber where `id` = ? and `subscribe` = 'all'", id).Scan(&all)
-        if all == 1 {
-            stmt, _ = rtx.Prepare("select seq_id, markid, markdate, marktime, GPS_y, GPS_x, addr, photo_loc from recv where timestamp(markdate, marktime) between convert_tz(date_sub(now(), interval 80 minute), 'system', '+08:00') and convert_tz(now(), 'system', '+08:00') order by marktime desc, seq_id limit 11")
-            rows, err = stmt.Query()
-        } else {
-            // Get User's Subscribing List and Search
-            subscribing, _ := tx.Query("select subscribe from subscriber where `id` = ?", id)
-            subscribes := []string{}
-            rowNums := 0
-            defer subscribing.Close()
-            for subscribing.Next() {
-                var subscribe string
-                subscribing.Scan(&subscribe)
-                subscribes = append(subscribes, subscribe)
-                rowNums += 1
-            }
-            if rowNums == 0 {
-                return []DefectDetail{}
-            }
-            args := make([]interface{}, len(subscribes))
-            for i, subscribe := range subscribes {
-                args[i] = subscribe
-            }
-            stmt, _ = rtx.Prepare(`select seq_id, markid, markdate, marktime, GPS_y, GPS_x, addr, photo_loc from recv where timestamp(markdate, marktime) between convert_tz(date_sub(now(), interval 80 minute), 'system', '+08:00') and convert_tz(now(), 'system', '+08:00') and markid in (?` + strings.Repeat(",?", len(args)-1) + `) order by marktime desc, seq_id limit 11`)
-            rows, err = stmt.Query(args...)
-        }
+    return listItem
+}
+
+func photoURIs(defectDetail DefectDetail) (string, string) {
+    /*
+       return : uri of the preview photo, uri of the original photo
+    */
+
+    photoDate := strings.Replace(defectDetail.markdate, "-", "", -1)
+    return fmt.Sprintf(`https://%s/v1/get/img/%s/previews/%s`, os.Getenv("ImageAPIHost"), photoDate, defectDetail.photo), fmt.Sprintf(`https://%s/v1/get/img/%s/originals/%s`, os.Getenv("ImageAPIHost"), photoDate, defectDetail.photo)
+}
+
+func retriveDefectDetail(id string, query DefectQuery) ([]DefectDetail, error) {
+    return retriveDefectPage(id, query, pageSize)
+}
+
+func retriveDefectPage(id string, query DefectQuery, size int) ([]DefectDetail, error) {
+    /*
+       []DefectDetail : up to size + 1 defects, the extra one tells there's a next page
+    */
+
+    query, ok, err := resolveQuery(id, query)
+    if !ok {
+        return []DefectDetail{}, err
     }
 
-    checkError(err)
-    defer func() {
-        stmt.Close()
-        rows.Close()
-    }()
+    // Page, the cursor already points past the previous ones
+    skip := 0
+    if query.cursor == "" {
+        skip = (query.page - 1) * size
+    }
 
     var defectDetails []DefectDetail
-    for rows.Next() {
-        var defectDetail DefectDetail
-        err = rows.Scan(&defectDetail.seq_id, &defectDetail.markid, &defectDetail.markdate, &defectDetail.marktime, &defectDetail.gps_y, &defectDetail.gps_x, &defectDetail.address, &defectDetail.photo)
-        checkError(err)
+    err = source.Defects(query, orderNewest, size+1, skip, func(defectDetail DefectDetail) error {
         defectDetails = append(defectDetails, defectDetail)
-    }
+        return nil
+    })
 
-    return defectDetails
+    return defectDetails, err
 }
 
-func summary(id string, arguments []string) linebot.FlexContainer {
-    for _, argument := range arguments {
-        if !matchString(`^D\d{2}|all$`, argument) {
-            return nil
-        }
-    }
-
+func summary(id string, query DefectQuery) (linebot.FlexContainer, error) {
     t := time.Now()
-    flexJson := []byte(fmt.Sprintf(`{"type":"bubble","body":{"type":"box","layout":"vertical","contents":[{"type":"text","text":"彙整","weight":"bold","size":"xxl","margin":"md"},{"type":"box","layout":"horizontal","contents":[{"type":"text","text":"生成時間","size":"sm","color":"#aaaaaa","flex":0,"margin":"none"},{"type":"text","text":"%s","size":"xs","color":"#aaaaaa","offsetStart":"md"}]},{"type":"separator","margin":"xxl"},{"type":"box","layout":"vertical","margin":"lg","spacing":"sm","contents":[]}]},"footer":{"type":"box","layout":"baseline","contents":[{"type":"text","text":"*過去80分鐘內","align":"end","size":"xs","color":"#aaaaaa"}]},"styles":{"footer":{"separator":true}}}`, t.Format("2006-01-02 15:04:05")))
+    flexJson := []byte(fmt.Sprintf(`{"type":"bubble","body":{"type":"box","layout":"vertical","contents":[{"type":"text","text":"彙整","weight":"bold","size":"xxl","margin":"md"},{"type":"box","layout":"horizontal","contents":[{"type":"text","text":"生成時間","size":"sm","color":"#aaaaaa","flex":0,"margin":"none"},{"type":"text","text":"%s","size":"xs","color":"#aaaaaa","offsetStart":"md"}]},{"type":"separator","margin":"xxl"},{"type":"box","layout":"vertical","margin":"lg","spacing":"sm","contents":[]}]},"footer":{"type":"box","layout":"baseline","contents":[{"type":"text","text":"*%s","align":"end","size":"xs","color":"#aaaaaa","wrap":true}]},"styles":{"footer":{"separator":true}}}`, t.Format("2006-01-02 15:04:05"), escapeJSON(formatCondition(query))))
     var flex interface{}
     json.Unmarshal(flexJson, &flex)
 
-    defects := retriveDefectNum(id, arguments)
+    defects, err := retriveDefectNum(id, query)
+    if err != nil {
+        return nil, err
+    }
     if len(defects) == 0 {
         listItemJson := []byte(`{"type":"text","text":"沒有任何資料"}`)
         var listItem interface{}
@@ -536,10 +1116,10 @@ func summary(id string, arguments []string) linebot.FlexContainer {
     } else {
         for _, defect := range defects {
             var listItemJson []byte
-            if defectnames[defect.markid] == "" {
+            if defectName(defect.markid) == "" {
                 listItemJson = []byte(fmt.Sprintf(`{"type":"box","layout":"horizontal","contents":[{"type":"text","text":"%s","size":"sm","color":"#555555","flex":0},{"type":"text","text":"%s筆","size":"sm","color":"#111111","align":"end"}]}`, defect.markid, strconv.Itoa(defect.num)))
             } else {
-                listItemJson = []byte(fmt.Sprintf(`{"type":"box","layout":"horizontal","contents":[{"type":"text","text":"%s(%s)","size":"sm","color":"#555555","flex":0},{"type":"text","text":"%s筆","size":"sm","color":"#111111","align":"end"}]}`, defectnames[defect.markid], defect.markid, strconv.Itoa(defect.num)))
+                listItemJson = []byte(fmt.Sprintf(`{"type":"box","layout":"horizontal","contents":[{"type":"text","text":"%s(%s)","size":"sm","color":"#555555","flex":0},{"type":"text","text":"%s筆","size":"sm","color":"#111111","align":"end"}]}`, escapeJSON(defectName(defect.markid)), defect.markid, strconv.Itoa(defect.num)))
             }
             var listItem interface{}
             json.Unmarshal(listItemJson, &listItem)
@@ -547,122 +1127,189 @@ func summary(id string, arguments []string) linebot.FlexContainer {
         }
     }
     flexResult, _ := json.Marshal(flex)
-    container, _ := linebot.UnmarshalFlexMessageJSON(flexResult)
-    return container
+    container, err := linebot.UnmarshalFlexMessageJSON(flexResult)
+    if err != nil {
+        return nil, err
+    }
+    return container, nil
+}
+
+func retriveDefectNum(id string, query DefectQuery) ([]Defect, error) {
+    query, ok, err := resolveQuery(id, query)
+    if !ok {
+        return []Defect{}, err
+    }
+
+    return source.CountDefects(query)
 }
 
-func retriveDefectNum(id string, arguments []string) []Defect {
-    tx, _ := db.Begin()
-    rtx, _ := rdb.Begin()
-    defer func() {
-        tx.Commit()
-        rtx.Commit()
-    }()
+func unseenQuery(id string, query DefectQuery) (DefectQuery, string, error) {
+    /*
+       DefectQuery : query limited to defects after the watermark of the chat
+       string : latest seq_id included, the next watermark
+    */
 
-    var stmt *sql.Stmt
-    var rows *sql.Rows
     var err error
+    if query.after, err = retriveWatermark(id); err != nil {
+        return query, "", err
+    }
+    latest, err := retriveLatestSeq(id, query)
+    query.until = latest
+    return query, latest, err
+}
+
+func retriveLatestSeq(id string, query DefectQuery) (string, error) {
+    query, ok, err := resolveQuery(id, query)
+    if !ok {
+        return "", err
+    }
+
+    return source.LatestSeq(query)
+}
+
+func retriveWatermark(id string) (string, error) {
+    var watermark sql.NullString
+    err := db.QueryRow("select seq_id from watermark where id = ?", id).Scan(&watermark)
+    if err == sql.ErrNoRows {
+        return "", nil
+    }
+    return watermark.String, err
+}
+
+func updateWatermark(id string, seq string) error {
+    if seq == "" {
+        return nil
+    }
+    _, err := db.Exec("insert into watermark (id, seq_id, updated_at) values (?, ?, datetime('now', 'localtime')) on conflict(id) do update set seq_id = max(seq_id, excluded.seq_id), updated_at = excluded.updated_at", id, seq)
+    return err
+}
 
-    if contains(arguments, "all") { // Retrive All Types
-        stmt, _ = rtx.Prepare("select markid, count(markid) from recv where timestamp(markdate, marktime) between convert_tz(date_sub(now(), interval 80 minute), 'system', '+08:00') and convert_tz(now(), 'system', '+08:00') group by markid")
-        rows, err = stmt.Query()
-    } else if len(arguments) >= 1 { // Retrive Specific Types
-        args := make([]interface{}, len(arguments))
-        for i, argument := range arguments {
-            args[i] = argument
-        }
-        stmt, _ = rtx.Prepare(`select markid, count(markid) from recv where timestamp(markdate, marktime) between convert_tz(date_sub(now(), interval 80 minute), 'system', '+08:00') and convert_tz(now(), 'system', '+08:00') and markid in (?` + strings.Repeat(",?", len(args)-1) + `) group by markid`)
-        rows, err = stmt.Query(args...)
-    } else { // Retrive Subscribed Types
-        var all int
-        tx.QueryRow("select count(*) from subscriber where `id` = ? and `subscribe` = 'all'", id).Scan(&all)
-        if all == 1 {
-            stmt, _ = rtx.Prepare("select markid, count(markid) from recv where timestamp(markdate, marktime) between convert_tz(date_sub(now(), interval 80 minute), 'system', '+08:00') and convert_tz(now(), 'system', '+08:00') group by markid")
-            rows, err = stmt.Query()
+func resolveQuery(id string, query DefectQuery) (DefectQuery, bool, error) {
+    /*
+       DefectQuery : query with subscribed types and area of the chat filled in
+       bool : false if the chat subscribes nothing
+    */
+
+    if len(query.markids) == 0 { // Retrive Subscribed Types
+        all, subscribes, err := retriveSubscribe(id)
+        if err != nil {
+            return query, false, err
+        }
+        if all {
+            query.markids = []string{"all"}
+        } else if len(subscribes) == 0 {
+            return query, false, nil
         } else {
-            // Get User's Subscribing List and Search
-            subscribing, _ := tx.Query("select subscribe from subscriber where `id` = ?", id)
-            subscribes := []string{}
-            rowNums := 0
-            defer subscribing.Close()
-            for subscribing.Next() {
-                var subscribe string
-                subscribing.Scan(&subscribe)
-                subscribes = append(subscribes, subscribe)
-                rowNums += 1
-            }
-            if rowNums == 0 {
-                return []Defect{}
-            }
-            args := make([]interface{}, len(subscribes))
-            for i, subscribe := range subscribes {
-                args[i] = subscribe
-            }
-            stmt, _ = rtx.Prepare(`select markid, count(markid) from recv where timestamp(markdate, marktime) between convert_tz(date_sub(now(), interval 80 minute), 'system', '+08:00') and convert_tz(now(), 'system', '+08:00') and markid in (?` + strings.Repeat(",?", len(args)-1) + `) group by markid`)
-            rows, err = stmt.Query(args...)
+            query.markids = subscribes
+        }
+    }
+    // The chat's area applies to every query of it, the one given in arguments takes its place
+    if query.area == nil && id != "" {
+        area, err := retriveGeofence(id)
+        if err != nil {
+            return query, false, err
         }
+        query.area = area
+    }
+    if query.area != nil {
+        area := query.area.resolve()
+        query.area = &area
     }
 
-    checkError(err)
-    defer func() {
-        stmt.Close()
-        rows.Close()
-    }()
+    return query, true, nil
+}
 
-    var defects []Defect
-    for rows.Next() {
-        var defect Defect
-        err = rows.Scan(&defect.markid, &defect.num)
-        checkError(err)
-        defects = append(defects, defect)
+func inArea(area *Geofence, gpsY string, gpsX string) bool {
+    if area == nil {
+        return true
     }
+    lat, lng, ok := detailLocation(DefectDetail{gps_y: gpsY, gps_x: gpsX})
+    return ok && area.contains(lat, lng)
+}
 
-    return defects
+func detailLocation(defectDetail DefectDetail) (float64, float64, bool) {
+    lat, err := strconv.ParseFloat(strings.TrimSpace(defectDetail.gps_y), 64)
+    if err != nil {
+        return 0, 0, false
+    }
+    lng, err := strconv.ParseFloat(strings.TrimSpace(defectDetail.gps_x), 64)
+    if err != nil {
+        return 0, 0, false
+    }
+    return lat, lng, true
 }
 
 func cronJob() {
     cronTabs := strings.Split(os.Getenv("Crontab"), ";")
-    cronJob := cron.New()
-    cronJob.AddFunc("* * * * *", DBKeepAlive) // Database keep-alive
+    scheduler = cron.New(cron.WithChain(cron.Recover(cron.DefaultLogger))) // A panicking job shouldn't stop the others
+    scheduler.AddFunc("* * * * *", DBKeepAlive) // Database keep-alive
+    scheduler.AddFunc("@daily", pruneWebhookDeliveries)
     for _, cronTab := range cronTabs {
-        cronJob.AddFunc(cronTab, routineJob)
+        scheduler.AddFunc(cronTab, routineJob)
+    }
+    if err := loadSchedules(); err != nil { // Chats with own schedules
+        log.Println(fmt.Sprintf(`Loading schedules failed : "%s".`, err))
     }
-    cronJob.Start()
+    scheduler.Start()
 }
 
 func routineJob() {
     log.Println("Start cron job.")
-    tx, _ := db.Begin()
-    defer func() {
-        tx.Commit()
-    }()
 
-    var stmt *sql.Stmt
-    var rows *sql.Rows
-    var err error
+    idList, err := retriveDigestChats()
+    if err != nil {
+        log.Println(fmt.Sprintf(`Cron job failed : "%s".`, err))
+        return
+    }
+
+    // One failing chat shouldn't keep the others from their digests
+    for _, id := range idList {
+        if err := pushDigest(id); err != nil {
+            log.Println(fmt.Sprintf(`Pushing digest to %s failed : "%s".`, id, err))
+        }
+    }
+    if err = notifyDigest(); err != nil {
+        log.Println(fmt.Sprintf(`Notifying webhooks of digest failed : "%s".`, err))
+    }
+}
 
-    stmt, _ = tx.Prepare(`select id from subscriber group by id`)
-    rows, err = stmt.Query()
-    checkError(err)
+func retriveDigestChats() ([]string, error) {
+    /*
+       []string : chats following the default schedule
+    */
+
+    rows, err := db.Query(`select id from subscriber where id not in (select id from delivery where quarantined = 1) and id not in (select id from schedule) group by id`)
+    if err != nil {
+        return nil, err
+    }
     defer rows.Close()
+
     var idList []string
     for rows.Next() {
         var id string
-        err = rows.Scan(&id)
-        checkError(err)
+        if err = rows.Scan(&id); err != nil {
+            return nil, err
+        }
         idList = append(idList, id)
     }
+    return idList, rows.Err()
+}
+
+func pushDigest(id string) error {
+    quarantined, err := isQuarantined(id)
+    if err != nil || quarantined {
+        return err
+    }
 
-    for _, id := range idList {
-        response, sending := inspect(id, []string{})
-        message := linebot.NewFlexMessage("缺陷詳情", response)
-        var err error
-        if (os.Getenv("OnlyPushingWhenData") == "true" && sending) || os.Getenv("OnlyPushingWhenData") == "false" {
-            if _, err = bot.PushMessage(id, message).Do(); err != nil {
-                log.Println(fmt.Sprintf(`ID %s is causing "%s", consider delete it in the database manually.`, id, err))
-            }
-        }
+    query, latest, err := unseenQuery(id, DefectQuery{markids: []string{}, window: defaultWindow, page: 1})
+    if err != nil {
+        return err
     }
+    sent, err := notify(id, Report{title: "缺陷詳情", query: query}, os.Getenv("OnlyPushingWhenData") == "true")
+    if sent && err == nil {
+        return updateWatermark(id, latest)
+    }
+    return err
 }
 
 func replyTextMessage(event *linebot.Event, response string) {
@@ -672,6 +1319,27 @@ func replyTextMessage(event *linebot.Event, response string) {
     }
 }
 
+func replySubscribeMessage(event *linebot.Event, id string, response string, offset int) {
+    message := linebot.NewTextMessage(response)
+    if quickReplies, err := subscribeQuickReplies(id, offset); err != nil { // Still reply, just without the buttons
+        log.Println(fmt.Sprintf(`Loading subscriptions of %s failed : "%s".`, id, err))
+    } else {
+        message.WithQuickReplies(quickReplies)
+    }
+    if _, err := bot.ReplyMessage(event.ReplyToken, message).Do(); err != nil {
+        log.Println(err)
+    }
+}
+
+func replyFailure(event *linebot.Event, id string, action string, err error) {
+    log.Println(fmt.Sprintf(`User %s failed to %s : "%s".`, id, action, err))
+    if errors.Is(err, errDatabaseUnavailable) {
+        replyTextMessage(event, _databaseUnavailable)
+        return
+    }
+    replyTextMessage(event, _failure)
+}
+
 func replyFlexMessage(event *linebot.Event, altText string, response linebot.FlexContainer) {
     var err error
     if _, err = bot.ReplyMessage(event.ReplyToken, linebot.NewFlexMessage(altText, response)).Do(); err != nil {
@@ -679,6 +1347,19 @@ func replyFlexMessage(event *linebot.Event, altText string, response linebot.Fle
     }
 }
 
+func sourceID(event *linebot.Event) (string, bool) {
+    switch event.Source.Type {
+    case "user":
+        return event.Source.UserID, true
+    case "group":
+        return event.Source.GroupID, true
+    case "room":
+        return event.Source.RoomID, true
+    default:
+        return "", false
+    }
+}
+
 func argumentSplitter(parameters []string) ([]string, error) {
     var arguments []string
     if length := len(parameters); parameters[len(parameters)-1] == "" {
@@ -691,6 +1372,231 @@ func argumentSplitter(parameters []string) ([]string, error) {
     return arguments, nil
 }
 
+func queryArguments(arguments []string) (DefectQuery, error) {
+    query := DefectQuery{markids: []string{}, page: 1}
+    arguments, area, err := areaArguments(arguments)
+    if err != nil {
+        return query, err
+    }
+    query.area = area
+    period := false
+    for i := 0; i < len(arguments); i++ {
+        argument := arguments[i]
+        if !period && parsePeriod(argument, &query) {
+            period = true
+        } else if argument == "page" && i+1 < len(arguments) {
+            page, err := strconv.Atoi(arguments[i+1])
+            if err != nil || page < 1 {
+                return query, errors.New("")
+            }
+            query.page = page
+            i++
+        } else if matchString(`^(D\d{2}|all)$`, argument) {
+            query.markids = append(query.markids, argument)
+        } else {
+            return query, errors.New("")
+        }
+    }
+    if !period {
+        query.window = defaultWindow
+    }
+    return query, nil
+}
+
+func encodeQuery(query DefectQuery) url.Values {
+    values := url.Values{}
+    values.Set("defects", strings.Join(query.markids, "."))
+    if query.window != 0 {
+        values.Set("window", strconv.Itoa(int(query.window/time.Minute)))
+    } else if !query.from.IsZero() {
+        values.Set("from", strconv.FormatInt(query.from.Unix(), 10))
+        values.Set("to", strconv.FormatInt(query.to.Unix(), 10))
+    }
+    values.Set("page", strconv.Itoa(query.page))
+    if query.cursor != "" {
+        values.Set("cursor", query.cursor)
+    }
+    if query.after != "" {
+        values.Set("after", query.after)
+    }
+    if query.until != "" {
+        values.Set("until", query.until)
+    }
+    if query.keyword != "" {
+        values.Set("keyword", query.keyword)
+    }
+    if query.area != nil && query.area.kind == "near" {
+        values.Set("near", fmt.Sprintf("%f,%f,%f", query.area.lat, query.area.lng, query.area.radius))
+    } else if query.area != nil {
+        values.Set("in", query.area.name)
+    }
+    return values
+}
+
+func decodeQuery(values url.Values) (DefectQuery, error) {
+    query := DefectQuery{markids: []string{}, cursor: values.Get("cursor"), after: values.Get("after"), until: values.Get("until")}
+    if !matchString(`^\d*$`, query.after) || !matchString(`^\d*$`, query.until) {
+        return query, errors.New("")
+    }
+    if query.keyword = values.Get("keyword"); !matchString(`^[^"\\%_]*$`, query.keyword) {
+        return query, errors.New("")
+    }
+    if near := strings.Split(values.Get("near"), ","); len(near) == 3 {
+        query.area = &Geofence{kind: "near"}
+        lat, latErr := strconv.ParseFloat(near[0], 64)
+        lng, lngErr := strconv.ParseFloat(near[1], 64)
+        radius, radiusErr := strconv.ParseFloat(near[2], 64)
+        if latErr != nil || lngErr != nil || radiusErr != nil {
+            return query, errors.New("")
+        }
+        query.area.lat, query.area.lng, query.area.radius = lat, lng, radius
+    } else if name := values.Get("in"); name != "" {
+        query.area = &Geofence{kind: "polygon", name: name}
+    }
+    if defects := values.Get("defects"); defects != "" {
+        for _, markid := range strings.Split(defects, ".") {
+            if !matchString(`^(D\d{2}|all)$`, markid) {
+                return query, errors.New("")
+            }
+            query.markids = append(query.markids, markid)
+        }
+    }
+    var err error
+    if query.page, err = strconv.Atoi(values.Get("page")); err != nil || query.page < 1 {
+        return query, errors.New("")
+    }
+    if window := values.Get("window"); window != "" {
+        minutes, err := strconv.Atoi(window)
+        if err != nil || minutes < 1 {
+            return query, errors.New("")
+        }
+        query.window = time.Duration(minutes) * time.Minute
+        return query, nil
+    }
+    if values.Get("from") == "" && query.after != "" { // Unseen defects are not limited by period
+        return query, nil
+    }
+    from, err := strconv.ParseInt(values.Get("from"), 10, 64)
+    if err != nil {
+        return query, errors.New("")
+    }
+    to, err := strconv.ParseInt(values.Get("to"), 10, 64)
+    if err != nil {
+        return query, errors.New("")
+    }
+    query.from, query.to = time.Unix(from, 0).In(remoteZone), time.Unix(to, 0).In(remoteZone)
+    return query, nil
+}
+
+func parsePeriod(s string, query *DefectQuery) bool {
+    if window, ok := parseWindow(s); ok {
+        query.window = window
+        return true
+    }
+    if from, to, ok := parseRange(s); ok {
+        query.window = 0
+        query.from, query.to = from, to
+        return true
+    }
+    return false
+}
+
+func parseWindow(s string) (time.Duration, bool) {
+    matches := regexp.MustCompile(`^([1-9]\d*)(m|h|d)$`).FindStringSubmatch(s)
+    if matches == nil {
+        return 0, false
+    }
+    num, err := strconv.Atoi(matches[1])
+    if err != nil {
+        return 0, false
+    }
+    switch matches[2] {
+    case "h":
+        return time.Duration(num) * time.Hour, true
+    case "d":
+        return time.Duration(num) * 24 * time.Hour, true
+    default:
+        return time.Duration(num) * time.Minute, true
+    }
+}
+
+func parseRange(s string) (time.Time, time.Time, bool) {
+    now := time.Now().In(remoteZone)
+    today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, remoteZone)
+    switch s {
+    case "today":
+        return today, today.AddDate(0, 0, 1).Add(-time.Second), true
+    case "yesterday":
+        return today.AddDate(0, 0, -1), today.Add(-time.Second), true
+    }
+
+    bounds := strings.Split(s, "..")
+    if len(bounds) > 2 {
+        return time.Time{}, time.Time{}, false
+    }
+    from, fromDay, ok := parseRangeBound(bounds[0])
+    if !ok || (len(bounds) == 1 && !fromDay) {
+        return time.Time{}, time.Time{}, false
+    }
+    to, toDay := from, fromDay
+    if len(bounds) == 2 {
+        if to, toDay, ok = parseRangeBound(bounds[1]); !ok {
+            return time.Time{}, time.Time{}, false
+        }
+    }
+    if toDay { // Whole day is included
+        to = to.AddDate(0, 0, 1).Add(-time.Second)
+    }
+    if to.Before(from) {
+        return time.Time{}, time.Time{}, false
+    }
+    return from, to, true
+}
+
+func parseRangeBound(s string) (time.Time, bool, bool) {
+    if t, err := time.ParseInLocation("2006-01-02", s, remoteZone); err == nil {
+        return t, true, true
+    }
+    if t, err := time.ParseInLocation("2006-01-02T15:04", s, remoteZone); err == nil {
+        return t, false, true
+    }
+    return time.Time{}, false, false
+}
+
+func formatCondition(query DefectQuery) string {
+    if query.keyword != "" {
+        return formatPeriod(query) + "，地址包含" + query.keyword
+    }
+    return formatPeriod(query)
+}
+
+func formatPeriod(query DefectQuery) string {
+    if query.window != 0 {
+        return "過去" + formatWindow(query.window) + "內"
+    }
+    if query.from.IsZero() {
+        return "上次查看後"
+    }
+    from, to := query.from, query.to.Add(time.Second)
+    if from.Format("15:04:05") == "00:00:00" && to.Format("15:04:05") == "00:00:00" {
+        if to.Sub(from) == 24*time.Hour {
+            return from.Format("2006-01-02")
+        }
+        return from.Format("2006-01-02") + " 至 " + query.to.Format("2006-01-02")
+    }
+    return from.Format("2006-01-02 15:04") + " 至 " + query.to.Format("2006-01-02 15:04")
+}
+
+func formatWindow(window time.Duration) string {
+    minutes := int(window / time.Minute)
+    if minutes%(24*60) == 0 {
+        return strconv.Itoa(minutes/(24*60)) + "天"
+    } else if minutes%60 == 0 {
+        return strconv.Itoa(minutes/60) + "小時"
+    }
+    return strconv.Itoa(minutes) + "分鐘"
+}
+
 func checkENV() bool {
 
     /*
@@ -708,12 +1614,32 @@ func checkENV() bool {
         {"ChannelSecret", reflect.String, ``, false, ``},
         {"ChannelAccessToken", reflect.String, ``, false, ``},
         {"CallbackPort", reflect.Int, ``, false, ``},
-        {"DatabaseHost", reflect.String, ``, false, ``},
-        {"DatabaseUser", reflect.String, ``, false, ``},
-        {"DatabasePassword", reflect.String, ``, false, ``},
+        {"DatabaseDriver", reflect.String, `^(mysql|postgres|sqlite3)$`, true, ``},
+        {"DatabaseHost", reflect.String, ``, true, ``},
+        {"DatabasePort", reflect.String, `^\d+$`, true, ``},
+        {"DatabaseUser", reflect.String, ``, true, ``},
+        {"DatabasePassword", reflect.String, ``, true, ``},
         {"DatabaseName", reflect.String, ``, false, ``},
+        {"DatabaseSSLMode", reflect.String, `^(disable|require|verify-ca|verify-full)$`, true, ``},
         {"Crontab", reflect.String, `^((((\d+,)+\d+|(\d+(\/|-|#)\d+)|\d+L?|\*(\/\d+)?|L(-\d+)?|\?|[A-Z]{3}(-[A-Z]{3})?) ?){5,7})$|(@(annually|yearly|monthly|weekly|daily|hourly|reboot))|(@every (\d+(ns|us|µs|ms|s|m|h))+)`, true, `;`},
         {"OnlyPushingWhenData", reflect.String, `^(true|false)$`, false, ``},
+        {"DefaultWindow", reflect.String, `^[1-9]\d*(m|h|d)$`, true, ``},
+        {"QuarantineThreshold", reflect.String, `^[1-9]\d*$`, true, ``},
+        {"WatchInterval", reflect.String, `^[1-9]\d*(s|m)$`, true, ``},
+        {"WatchBatch", reflect.String, `^\d+(s|m)$`, true, ``},
+        {"GeofenceFile", reflect.String, ``, true, ``},
+        {"NearbyRadius", reflect.String, `^[1-9]\d*(m|km)$`, true, ``},
+        {"NearbyWindow", reflect.String, `^[1-9]\d*(m|h|d)$`, true, ``},
+        {"PublicURL", reflect.String, `^https://`, true, ``},
+        {"LinkSecret", reflect.String, `^.{32,}$`, true, ``},
+        {"SMTPHost", reflect.String, ``, true, ``},
+        {"SMTPPort", reflect.String, `^\d+$`, true, ``},
+        {"SMTPUser", reflect.String, ``, true, ``},
+        {"SMTPPassword", reflect.String, ``, true, ``},
+        {"SMTPFrom", reflect.String, ``, true, ``},
+        {"TelegramBotToken", reflect.String, `^\d+:[\w-]+$`, true, ``},
+        {"TelegramAPI", reflect.String, `^https?://`, true, ``},
+        {"AdminIDs", reflect.String, `^(U|R|C)(\w{32})$`, true, `,`},
     }
 
     for _, env := range envList {
@@ -731,7 +1657,7 @@ func checkENV() bool {
         }
         if env._type == reflect.String && env.regexp != "" {
             if os.Getenv(env.name) == "" && env.allowEmpty {
-                return false
+                continue
             }
             if env.multiValueSeperator != "" {
                 envSeperateds := strings.Split(os.Getenv(env.name), env.multiValueSeperator)
@@ -750,6 +1676,18 @@ func checkENV() bool {
         }
     }
 
+    // Links under PublicURL are signed with their own key, rotating it only expires the links
+    if os.Getenv("PublicURL") != "" && os.Getenv("LinkSecret") == "" {
+        log.Println("LinkSecret is empty while PublicURL is set.")
+        return true
+    }
+
+    // SQLite only needs the path of the file in DatabaseName
+    if os.Getenv("DatabaseDriver") != "sqlite3" && (os.Getenv("DatabaseHost") == "" || os.Getenv("DatabaseUser") == "") {
+        log.Println("DatabaseHost and DatabaseUser are empty.")
+        return true
+    }
+
     return false
 
 }
@@ -765,75 +1703,68 @@ func intialLocalDatabase() *sql.DB {
         log.Println("Local database established.")
     }
 
-    sql_table := `
-    CREATE TABLE IF NOT EXISTS "subscriber" (
-        "id"	varchar(33) PRIMARY KEY,
-        "subscribe"	varchar(3),
-        CONSTRAINT "id_subscribe" UNIQUE("id","subscribe")
-    );
-    `
-    _, err = db.Exec(sql_table)
-    checkError(err)
+    if err = migrateLocalDatabase(db); err != nil {
+        log.Fatal("Migrating local database failed : ", err)
+    }
 
     return db
 
 }
 
-func intialRemoteDatabase() *sql.DB {
-
-    databaseAuth := map[string]string{
-        "Host":     os.Getenv("DatabaseHost"),
-        "User":     os.Getenv("DatabaseUser"),
-        "Password": os.Getenv("DatabasePassword"),
-        "Name":     os.Getenv("DatabaseName"),
-    }
-
-    db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", databaseAuth["User"], databaseAuth["Password"], databaseAuth["Host"], 3306, databaseAuth["Name"]))
-    checkError(err)
-    db.SetConnMaxLifetime(time.Minute * 3)
-    db.SetMaxOpenConns(10)
-    db.SetMaxIdleConns(10)
-    _, err = db.Exec("do 1")
-
+func intialRemoteDatabase() DefectSource {
+    source, err := newDefectSource()
     if err != nil {
         log.Fatal("Loading remote database error : ", err)
-        os.Exit(1)
-    } else {
-        log.Println("Remote database established.")
     }
 
-    stmt, err := db.Prepare("select * from roadmark")
-    if err != nil {
-        log.Fatal("Loading roadmarks failed : ", err)
-        os.Exit(1)
+    // Starting while the remote database is down only leaves the circuit open until it's back
+    breaker := newBreakerSource(source, func() { loadRoadmarks(source) })
+    if err := source.Ping(); err != nil {
+        log.Println(fmt.Sprintf(`Remote database is unreachable, starting without it : "%s".`, err))
+        breaker.trip(err)
     } else {
-        log.Println("Loaded roadmarks")
+        log.Println("Remote database established.")
+        loadRoadmarks(source)
     }
-    rows, _ := stmt.Query()
 
-    defer stmt.Close()
+    return breaker
 
-    defectnames = make(map[string]string)
-    for rows.Next() {
-        var roadmark Roadmark
-        err = rows.Scan(&roadmark.markid, &roadmark.name)
-        checkError(err)
-        defectnames[roadmark.markid] = roadmark.name
-    }
+}
 
-    return db
+func loadRoadmarks(source DefectSource) {
+    names, err := source.Roadmarks()
+    if err != nil {
+        log.Println(fmt.Sprintf(`Loading roadmarks failed : "%s".`, err))
+        return
+    }
+    defectnamesLock.Lock()
+    defectnames = names
+    defectnamesLock.Unlock()
+    log.Println("Loaded roadmarks")
+}
 
+func defectName(markid string) string {
+    defectnamesLock.RLock()
+    defer defectnamesLock.RUnlock()
+    return defectnames[markid]
 }
 
-func DBKeepAlive() {
-    if err := rdb.Ping(); err != nil {
-        log.Fatal(err)
+func defectMarkids() []string {
+    defectnamesLock.RLock()
+    markids := make([]string, 0, len(defectnames))
+    for markid := range defectnames {
+        markids = append(markids, markid)
     }
+    defectnamesLock.RUnlock()
+    sort.Strings(markids)
+    return markids
 }
 
-func checkError(err error) {
-    if err != nil {
-        log.Fatal(err)
+func DBKeepAlive() {
+    if err := source.Ping(); err != nil && err != errDatabaseUnavailable { // Unavailable means it's already reconnecting
+        log.Println(fmt.Sprintf(`Remote database is unreachable : "%s".`, err))
+    } else if err == nil && len(defectMarkids()) == 0 { // Roadmarks failed to load earlier
+        loadRoadmarks(source)
     }
 }
 
@@ -847,8 +1778,13 @@ func contains(s []string, str string) bool {
     return false
 }
 
+func escapeJSON(s string) string {
+    // Text from users or the database, quotes and newlines would break the flex JSON built with Sprintf
+    quoted, _ := json.Marshal(s)
+    return string(quoted[1 : len(quoted)-1])
+}
+
 func matchString(pattern string, s string) bool {
-    match, err := regexp.MatchString(pattern, s)
-    checkError(err)
-    return match
+    // Patterns are all literals, so a bad one is a bug rather than a runtime failure
+    return regexp.MustCompile(pattern).MatchString(s)
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestParseRange(t *testing.T) {
+    day := func(year int, month time.Month, date int, hour int, min int, sec int) time.Time {
+        return time.Date(year, month, date, hour, min, sec, 0, remoteZone)
+    }
+    now := time.Now().In(remoteZone)
+    today := day(now.Year(), now.Month(), now.Day(), 0, 0, 0)
+
+    tests := []struct {
+        s    string
+        from time.Time
+        to   time.Time
+        ok   bool
+    }{
+        {"2026-10-01", day(2026, 10, 1, 0, 0, 0), day(2026, 10, 1, 23, 59, 59), true},
+        {"2026-10-01..2026-10-31", day(2026, 10, 1, 0, 0, 0), day(2026, 10, 31, 23, 59, 59), true},
+        {"2026-10-01T08:00..2026-10-01T17:30", day(2026, 10, 1, 8, 0, 0), day(2026, 10, 1, 17, 30, 0), true},
+        {"2026-10-01T08:00..2026-10-02", day(2026, 10, 1, 8, 0, 0), day(2026, 10, 2, 23, 59, 59), true},
+        {"2026-10-01..2026-10-01", day(2026, 10, 1, 0, 0, 0), day(2026, 10, 1, 23, 59, 59), true},
+        {"today", today, today.AddDate(0, 0, 1).Add(-time.Second), true},
+        {"yesterday", today.AddDate(0, 0, -1), today.Add(-time.Second), true},
+        {"2026-10-31..2026-10-01", time.Time{}, time.Time{}, false},
+        {"2026-10-01T08:00", time.Time{}, time.Time{}, false},
+        {"2026-10-01..2026-10-02..2026-10-03", time.Time{}, time.Time{}, false},
+        {"2026-13-01", time.Time{}, time.Time{}, false},
+        {"2026/10/01", time.Time{}, time.Time{}, false},
+        {"2026-10-01..", time.Time{}, time.Time{}, false},
+    }
+
+    for _, test := range tests {
+        from, to, ok := parseRange(test.s)
+        if ok != test.ok || !from.Equal(test.from) || !to.Equal(test.to) {
+            t.Errorf("parseRange(%q) = %s, %s, %v, want %s, %s, %v", test.s, from, to, ok, test.from, test.to, test.ok)
+        }
+    }
+}
+
+func TestQueryArguments(t *testing.T) {
+    geofences = map[string]Geofence{"中正區": {kind: "polygon", name: "中正區"}}
+
+    tests := []struct {
+        name      string
+        arguments []string
+        want      DefectQuery
+        ok        bool
+    }{
+        {"default window", []string{}, DefectQuery{markids: []string{}, window: defaultWindow, page: 1}, true},
+        {"markids and window", []string{"D10", "D20", "3h"}, DefectQuery{markids: []string{"D10", "D20"}, window: 3 * time.Hour, page: 1}, true},
+        {"all in days", []string{"all", "7d"}, DefectQuery{markids: []string{"all"}, window: 7 * 24 * time.Hour, page: 1}, true},
+        {"range and page", []string{"2026-10-01..2026-10-02", "D10", "page", "3"}, DefectQuery{markids: []string{"D10"}, from: time.Date(2026, 10, 1, 0, 0, 0, 0, remoteZone), to: time.Date(2026, 10, 2, 23, 59, 59, 0, remoteZone), page: 3}, true},
+        {"near with radius", []string{"D10", "near", "25.0478,121.5170", "1km"}, DefectQuery{markids: []string{"D10"}, window: defaultWindow, page: 1, area: &Geofence{kind: "near", lat: 25.0478, lng: 121.5170, radius: 1000}}, true},
+        {"near default radius", []string{"near", "25.0478,121.5170"}, DefectQuery{markids: []string{}, window: defaultWindow, page: 1, area: &Geofence{kind: "near", lat: 25.0478, lng: 121.5170, radius: defaultRadius}}, true},
+        {"named area", []string{"in", "中正區", "1d"}, DefectQuery{markids: []string{}, window: 24 * time.Hour, page: 1, area: &Geofence{kind: "polygon", name: "中正區"}}, true},
+        {"second period", []string{"3h", "1d"}, DefectQuery{}, false},
+        {"unknown markid", []string{"X10"}, DefectQuery{}, false},
+        {"page zero", []string{"page", "0"}, DefectQuery{}, false},
+        {"unknown area", []string{"in", "大安區"}, DefectQuery{}, false},
+        {"latitude out of range", []string{"near", "95,121.5170"}, DefectQuery{}, false},
+    }
+
+    for _, test := range tests {
+        query, err := queryArguments(test.arguments)
+        if (err == nil) != test.ok {
+            t.Errorf("%s got error %v, want ok %v", test.name, err, test.ok)
+            continue
+        }
+        if test.ok && !reflect.DeepEqual(query, test.want) {
+            t.Errorf("%s got %+v, want %+v", test.name, query, test.want)
+        }
+    }
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "log"
+)
+
+// Change To The Local Database, Applied Once In Order Of version
+type Migration struct {
+    version    int
+    name       string
+    statements string
+}
+
+// Migrations Of data.db, Only Ever Append New Ones, Never Edit Applied Ones
+var migrations = []Migration{
+    {1, "initial", `
+    CREATE TABLE IF NOT EXISTS "subscriber" (
+        "id"	varchar(33) PRIMARY KEY,
+        "subscribe"	varchar(3),
+        CONSTRAINT "id_subscribe" UNIQUE("id","subscribe")
+    );
+    CREATE TABLE IF NOT EXISTS "schedule" (
+        "id"	varchar(33),
+        "spec"	varchar(64),
+        CONSTRAINT "id_spec" UNIQUE("id","spec")
+    );
+    CREATE TABLE IF NOT EXISTS "watermark" (
+        "id"	varchar(33) PRIMARY KEY,
+        "seq_id"	integer NOT NULL,
+        "updated_at"	datetime
+    );
+    CREATE TABLE IF NOT EXISTS "watcher" (
+        "name"	varchar(16) PRIMARY KEY,
+        "seq_id"	integer NOT NULL
+    );
+    CREATE TABLE IF NOT EXISTS "geofence" (
+        "id"	varchar(33) PRIMARY KEY,
+        "kind"	varchar(8) NOT NULL,
+        "lat"	real,
+        "lng"	real,
+        "radius"	real,
+        "name"	varchar(64)
+    );
+    CREATE TABLE IF NOT EXISTS "apikey" (
+        "id"	integer PRIMARY KEY AUTOINCREMENT,
+        "name"	varchar(64) NOT NULL,
+        "hash"	char(64) NOT NULL UNIQUE,
+        "scopes"	varchar(64) NOT NULL,
+        "chats"	text NOT NULL,
+        "expires_at"	datetime,
+        "created_at"	datetime,
+        "revoked"	integer NOT NULL DEFAULT 0
+    );
+    CREATE TABLE IF NOT EXISTS "webhook" (
+        "id"	integer PRIMARY KEY AUTOINCREMENT,
+        "url"	text NOT NULL,
+        "secret"	text NOT NULL,
+        "markids"	text NOT NULL,
+        "created_at"	datetime,
+        "disabled"	integer NOT NULL DEFAULT 0
+    );
+    CREATE TABLE IF NOT EXISTS "webhook_delivery" (
+        "id"	integer PRIMARY KEY AUTOINCREMENT,
+        "webhook_id"	integer NOT NULL,
+        "delivery_id"	varchar(24) NOT NULL,
+        "event"	varchar(16) NOT NULL,
+        "status"	integer,
+        "attempts"	integer NOT NULL,
+        "error"	text,
+        "created_at"	datetime
+    );
+    CREATE TABLE IF NOT EXISTS "delivery" (
+        "id"	varchar(33) PRIMARY KEY,
+        "failures"	integer NOT NULL DEFAULT 0,
+        "reason"	varchar(16),
+        "error"	text,
+        "quarantined"	integer NOT NULL DEFAULT 0,
+        "updated_at"	datetime
+    );
+    `},
+    // id was the primary key, so a chat could only hold one subscription
+    {2, "subscriber_rows_per_type", `
+    CREATE TABLE "subscriber_new" (
+        "id"	varchar(33) NOT NULL,
+        "subscribe"	varchar(3) NOT NULL,
+        CONSTRAINT "id_subscribe" UNIQUE("id","subscribe")
+    );
+    INSERT OR IGNORE INTO "subscriber_new" ("id", "subscribe") SELECT "id", "subscribe" FROM "subscriber" WHERE "id" IS NOT NULL AND "subscribe" IS NOT NULL;
+    DROP TABLE "subscriber";
+    ALTER TABLE "subscriber_new" RENAME TO "subscriber";
+    `},
+}
+
+func migrateLocalDatabase(db *sql.DB) error {
+    _, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS "migration" (
+        "version"	integer PRIMARY KEY,
+        "name"	varchar(64) NOT NULL,
+        "applied_at"	datetime
+    );
+    `)
+    if err != nil {
+        return err
+    }
+
+    var current int
+    if err = db.QueryRow(`select coalesce(max(version), 0) from migration`).Scan(&current); err != nil {
+        return err
+    }
+    if latest := migrations[len(migrations)-1].version; current > latest {
+        return fmt.Errorf("data.db is at version %d, newer than %d known to this build", current, latest)
+    }
+
+    for _, migration := range migrations {
+        if migration.version <= current {
+            continue
+        }
+        if err = applyMigration(db, migration); err != nil {
+            return fmt.Errorf("migration %d %s: %w", migration.version, migration.name, err)
+        }
+        log.Println(fmt.Sprintf("Applied migration %d %s.", migration.version, migration.name))
+    }
+
+    return nil
+}
+
+func applyMigration(db *sql.DB, migration Migration) error {
+    // Each migration is applied entirely or not at all
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    if _, err = tx.Exec(migration.statements); err != nil {
+        tx.Rollback()
+        return err
+    }
+    if _, err = tx.Exec(`insert into migration (version, name, applied_at) values (?, ?, datetime('now', 'localtime'))`, migration.version, migration.name); err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit()
+}
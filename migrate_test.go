@@ -0,0 +1,117 @@
+package main
+
+import (
+    "database/sql"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+// Local Database As Created Before Migrations, A Chat Could Only Hold One Subscription
+const legacyLocalDatabase = `
+CREATE TABLE "subscriber" (
+    "id"	varchar(33) PRIMARY KEY,
+    "subscribe"	varchar(3),
+    CONSTRAINT "id_subscribe" UNIQUE("id","subscribe")
+);
+CREATE TABLE "schedule" (
+    "id"	varchar(33),
+    "spec"	varchar(64),
+    CONSTRAINT "id_spec" UNIQUE("id","spec")
+);
+INSERT INTO "subscriber" VALUES ('U00000000000000000000000000000001', 'all');
+INSERT INTO "subscriber" VALUES ('U00000000000000000000000000000002', 'D10');
+INSERT INTO "subscriber" VALUES ('C00000000000000000000000000000003', 'D20');
+INSERT INTO "schedule" VALUES ('U00000000000000000000000000000002', '0 8 * * *');
+`
+
+func subscriberRows(t *testing.T, db *sql.DB) [][2]string {
+    rows, err := db.Query("select id, subscribe from subscriber order by id, subscribe")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer rows.Close()
+    result := [][2]string{}
+    for rows.Next() {
+        var row [2]string
+        if err = rows.Scan(&row[0], &row[1]); err != nil {
+            t.Fatal(err)
+        }
+        result = append(result, row)
+    }
+    return result
+}
+
+func localSchema(t *testing.T, db *sql.DB) map[string]string {
+    rows, err := db.Query("select name, sql from sqlite_master where sql is not null")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer rows.Close()
+    schema := map[string]string{}
+    for rows.Next() {
+        var name, statement string
+        if err = rows.Scan(&name, &statement); err != nil {
+            t.Fatal(err)
+        }
+        schema[name] = statement
+    }
+    return schema
+}
+
+func TestMigrateLegacyLocalDatabase(t *testing.T) {
+    db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "data.db"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    if _, err = db.Exec(legacyLocalDatabase); err != nil {
+        t.Fatal(err)
+    }
+    legacyRows := subscriberRows(t, db)
+
+    if err = migrateLocalDatabase(db); err != nil {
+        t.Fatal(err)
+    }
+    if rows := subscriberRows(t, db); !reflect.DeepEqual(rows, legacyRows) {
+        t.Errorf("subscribers got %v, want %v", rows, legacyRows)
+    }
+    var spec string
+    if err = db.QueryRow("select spec from schedule where id = 'U00000000000000000000000000000002'").Scan(&spec); err != nil || spec != "0 8 * * *" {
+        t.Errorf("schedule got %q, %v", spec, err)
+    }
+    var version int
+    if err = db.QueryRow("select max(version) from migration").Scan(&version); err != nil || version != migrations[len(migrations)-1].version {
+        t.Errorf("version got %d, %v, want %d", version, err, migrations[len(migrations)-1].version)
+    }
+
+    // A chat can hold several subscriptions now, the same one only once
+    for _, subscribe := range []string{"D20", "D30"} {
+        if _, err = db.Exec("insert into subscriber (id, subscribe) values ('U00000000000000000000000000000002', ?)", subscribe); err != nil {
+            t.Fatalf("subscribing %s failed : %s", subscribe, err)
+        }
+    }
+    if _, err = db.Exec("insert into subscriber (id, subscribe) values ('U00000000000000000000000000000002', 'D10')"); err == nil {
+        t.Error("duplicated subscription accepted")
+    }
+    rows := subscriberRows(t, db)
+    schema := localSchema(t, db)
+    var applied int
+    db.QueryRow("select count(*) from migration").Scan(&applied)
+
+    // Running again changes nothing
+    if err = migrateLocalDatabase(db); err != nil {
+        t.Fatal(err)
+    }
+    if again := subscriberRows(t, db); !reflect.DeepEqual(again, rows) {
+        t.Errorf("second run subscribers got %v, want %v", again, rows)
+    }
+    if again := localSchema(t, db); !reflect.DeepEqual(again, schema) {
+        t.Errorf("second run changed the schema")
+    }
+    var appliedAgain int
+    db.QueryRow("select count(*) from migration").Scan(&appliedAgain)
+    if appliedAgain != applied {
+        t.Errorf("second run applied %d migrations", appliedAgain-applied)
+    }
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "sort"
+    "time"
+
+    "github.com/icza/dyno"
+    "github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// Default Radius And Period Searched Around A Shared Location
+const defaultNearbyRadius = 1000
+const defaultNearbyWindow = 24 * time.Hour
+
+// Most Defects Read Around A Location Before Sorting By Distance
+const nearbyFetchLimit = 500
+
+func nearby(lat float64, lng float64) (linebot.FlexContainer, bool, error) {
+    radius, ok := parseRadius(os.Getenv("NearbyRadius"))
+    if !ok {
+        radius = defaultNearbyRadius
+    }
+    window, ok := parseWindow(os.Getenv("NearbyWindow"))
+    if !ok {
+        window = defaultNearbyWindow
+    }
+    area := &Geofence{kind: "near", lat: lat, lng: lng, radius: radius}
+    query := DefectQuery{markids: []string{"all"}, window: window, page: 1, area: area}
+
+    // Initial empty flexbox for line
+    flexJson := []byte(`{"type":"carousel","contents":[]}`)
+    var flex interface{}
+    json.Unmarshal(flexJson, &flex)
+
+    t := time.Now()
+
+    defectDetails, distances, err := retriveNearbyDefects(query)
+    if err != nil {
+        return nil, false, err
+    }
+    if len(defectDetails) == 0 {
+        listItemJson := []byte(fmt.Sprintf(`{"type":"bubble","size":"kilo","body":{"type":"box","layout":"vertical","contents":[{"type":"text","text":"生成時間 %s","color":"#aaaaaa","size":"sm"},{"type":"text","text":"附近%s內","size":"xl"},{"type":"text","text":"%s","size":"xl","wrap":true,"align":"center"},{"type":"text","text":"沒有任何資料","size":"xl"}],"alignItems":"center","justifyContent":"center"}}`, t.Format("2006-01-02 15:04:05"), formatDistance(radius), formatPeriod(query)))
+        var listItem interface{}
+        json.Unmarshal(listItemJson, &listItem)
+        dyno.Append(flex, listItem, "contents")
+    } else {
+        // Header
+        headerJson := []byte(fmt.Sprintf(`{"type":"bubble","size":"kilo","body":{"type":"box","layout":"vertical","contents":[{"type":"text","text":"附近缺陷","weight":"bold","size":"xxl","margin":"md"},{"type":"box","layout":"horizontal","contents":[{"type":"text","text":"生成時間","size":"sm","color":"#aaaaaa","flex":0,"margin":"none"},{"type":"text","text":"%s","size":"xs","color":"#aaaaaa","offsetStart":"md"}]},{"type":"separator","margin":"xxl"},{"type":"box","layout":"vertical","margin":"lg","spacing":"sm","contents":[{"type":"text","text":"最近的%d筆缺陷","size":"sm","color":"#555555"},{"type":"text","text":"依距離由近至遠排列","size":"sm","color":"#555555"}]}]},"footer":{"type":"box","layout":"baseline","contents":[{"type":"text","text":"*附近%s內，%s","align":"end","size":"xs","color":"#aaaaaa","wrap":true}]},"styles":{"footer":{"separator":true}}}`, t.Format("2006-01-02 15:04:05"), len(defectDetails), formatDistance(radius), formatPeriod(query)))
+        var header interface{}
+        json.Unmarshal(headerJson, &header)
+        dyno.Append(flex, header, "contents")
+
+        // Detail
+        for i, defectDetail := range defectDetails {
+            listItem := detailBubble(defectDetail)
+            dyno.Append(listItem, distanceRow(distances[i]), "body", "contents")
+            dyno.Append(flex, listItem, "contents")
+        }
+    }
+
+    // Interface to line flex struct
+    flexResult, _ := json.Marshal(flex)
+    container, err := linebot.UnmarshalFlexMessageJSON(flexResult)
+    if err != nil {
+        return nil, false, err
+    }
+
+    return container, !(len(defectDetails) == 0), nil
+}
+
+func distanceRow(meters float64) interface{} {
+    distanceJson := []byte(fmt.Sprintf(`{"type":"box","layout":"baseline","contents":[{"type":"icon","size":"xs","url":"https://akveo.github.io/eva-icons/outline/png/128/navigation-2-outline.png"},{"type":"text","text":"距離%s","size":"md","color":"#8c8c8c","flex":0,"margin":"sm"}],"alignItems":"center"}`, formatDistance(meters)))
+    var distance interface{}
+    json.Unmarshal(distanceJson, &distance)
+
+    return distance
+}
+
+func retriveNearbyDefects(query DefectQuery) ([]DefectDetail, []float64, error) {
+    /*
+       []DefectDetail : nearest defects, sorted by distance
+       []float64 : distance of each defect, in meters
+    */
+
+    type nearbyDefect struct {
+        detail DefectDetail
+        meters float64
+    }
+    var nearbyDefects []nearbyDefect
+    // Newest ones first, so a busy spot can't make a query read too many
+    err := source.Defects(query, orderNewest, nearbyFetchLimit, 0, func(defectDetail DefectDetail) error {
+        lat, lng, _ := detailLocation(defectDetail)
+        nearbyDefects = append(nearbyDefects, nearbyDefect{defectDetail, distance(query.area.lat, query.area.lng, lat, lng)})
+        return nil
+    })
+    if err != nil {
+        return nil, nil, err
+    }
+    sort.SliceStable(nearbyDefects, func(i, j int) bool { return nearbyDefects[i].meters < nearbyDefects[j].meters })
+    if len(nearbyDefects) > pageSize {
+        nearbyDefects = nearbyDefects[:pageSize]
+    }
+
+    defectDetails := make([]DefectDetail, len(nearbyDefects))
+    distances := make([]float64, len(nearbyDefects))
+    for i, nearbyDefect := range nearbyDefects {
+        defectDetails[i], distances[i] = nearbyDefect.detail, nearbyDefect.meters
+    }
+    return defectDetails, distances, nil
+}
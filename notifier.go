@@ -0,0 +1,127 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// Report Pushed To A Target, Rendered By Its Notifier
+type Report struct {
+    title   string // Alt text of LINE, subject of email
+    header  string // Optional text before the defects
+    text    string // Plain text only, without any defects
+    summary bool   // Numbers of each type instead of details
+    query   DefectQuery
+}
+
+type Notifier interface {
+    // Push renders report for id and sends it, false if skipped because there's no defect
+    Push(id string, report Report, skipEmpty bool) (bool, error)
+}
+
+// Prefixes Of Target IDs Not On LINE
+const (
+    emailPrefix    = "mailto:"
+    telegramPrefix = "tg:"
+)
+
+func notifierFor(id string) (Notifier, bool) {
+    switch {
+    case matchString(`^(U|R|C)(\w{32})$`, id):
+        return lineNotifier{}, true
+    case strings.HasPrefix(id, emailPrefix) && matchString(`^[^@\s<>,;]+@[^@\s<>,;]+\.[^@\s<>,;]+$`, strings.TrimPrefix(id, emailPrefix)):
+        return emailNotifier{}, true
+    case strings.HasPrefix(id, telegramPrefix) && matchString(`^-?\d+$`, strings.TrimPrefix(id, telegramPrefix)):
+        return telegramNotifier{}, true
+    }
+    return nil, false
+}
+
+func validTarget(id string) bool {
+    _, ok := notifierFor(id)
+    return ok
+}
+
+func notify(id string, report Report, skipEmpty bool) (bool, error) {
+    notifier, ok := notifierFor(id)
+    if !ok {
+        return false, fmt.Errorf("unknown target %s", id)
+    }
+    return notifier.Push(id, report, skipEmpty)
+}
+
+type lineNotifier struct{}
+
+func (lineNotifier) Push(id string, report Report, skipEmpty bool) (bool, error) {
+    var messages []linebot.SendingMessage
+    if report.header != "" {
+        messages = append(messages, linebot.NewTextMessage(report.header))
+    }
+    switch {
+    case report.text != "":
+        messages = append(messages, linebot.NewTextMessage(report.text))
+    case report.summary:
+        defects, err := retriveDefectNum(id, report.query)
+        if err != nil {
+            return false, err
+        }
+        if skipEmpty && len(defects) == 0 {
+            return false, nil
+        }
+        response, err := summary(id, report.query)
+        if err != nil {
+            return false, err
+        }
+        messages = append(messages, linebot.NewFlexMessage(report.title, response))
+    default:
+        response, sending, err := inspect(id, report.query)
+        if err != nil {
+            return false, err
+        }
+        if skipEmpty && !sending {
+            return false, nil
+        }
+        messages = append(messages, linebot.NewFlexMessage(report.title, response))
+    }
+    return true, pushMessage(id, messages...)
+}
+
+// Defects Fetched For Backends Rendering Them Themselves
+type reportData struct {
+    defects []Defect
+    details []DefectDetail
+    total   int
+    hasNext bool
+}
+
+func retriveReportData(id string, report Report) (reportData, error) {
+    var data reportData
+    if report.text != "" {
+        return data, nil
+    }
+    var err error
+    if data.defects, err = retriveDefectNum(id, report.query); err != nil {
+        return data, err
+    }
+    for _, defect := range data.defects {
+        data.total += defect.num
+    }
+    if !report.summary {
+        if data.details, err = retriveDefectDetail(id, report.query); err != nil {
+            return data, err
+        }
+        if data.hasNext = len(data.details) > pageSize; data.hasNext {
+            data.details = data.details[:pageSize]
+        }
+    }
+    return data, nil
+}
+
+func formatDefectType(markid string) string {
+    if defectName(markid) == "" {
+        return markid
+    }
+    return defectName(markid) + `(` + markid + `)`
+}
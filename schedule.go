@@ -0,0 +1,221 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/robfig/cron/v3"
+)
+
+// Declare Global Cron Scheduler
+var scheduler *cron.Cron
+
+// Declare Global Cron Entries Of Chats Having Own Schedules
+var chatEntries = map[string][]cron.EntryID{}
+var chatEntriesLock sync.Mutex
+
+// Number Of Upcoming Runs Shown By schedule list
+const upcomingRuns = 3
+
+// Shortest Gap Between Two Pushes Of A Chat's Own Schedule, Pushes Share The Channel's Quota
+const minScheduleInterval = time.Hour
+
+// Upcoming Runs Checked Against minScheduleInterval
+const checkedRuns = 48
+
+var errScheduleTooFrequent = fmt.Errorf("schedule runs more often than every %s", minScheduleInterval)
+
+func loadSchedules() error {
+    rows, err := db.Query("select id, spec from schedule order by id")
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    specs := map[string][]string{}
+    for rows.Next() {
+        var id, spec string
+        if err = rows.Scan(&id, &spec); err != nil {
+            return err
+        }
+        specs[id] = append(specs[id], spec)
+    }
+    if err = rows.Err(); err != nil {
+        return err
+    }
+
+    for id, chatSpecs := range specs {
+        if err := registerSchedule(id, chatSpecs); err != nil {
+            log.Println(fmt.Sprintf(`Schedule of %s is invalid : "%s".`, id, err))
+        }
+    }
+    log.Println(fmt.Sprintf("Loaded schedules of %d chats.", len(specs)))
+    return nil
+}
+
+func registerSchedule(id string, specs []string) error {
+    // Stored schedules are checked again, they may predate the rules
+    if err := validSchedule(specs); err != nil {
+        return err
+    }
+    schedules := make([]cron.Schedule, len(specs))
+    for i, spec := range specs {
+        schedule, err := parseSchedule(spec)
+        if err != nil {
+            return err
+        }
+        schedules[i] = schedule
+    }
+
+    chatEntriesLock.Lock()
+    defer chatEntriesLock.Unlock()
+
+    for _, entry := range chatEntries[id] {
+        scheduler.Remove(entry)
+    }
+    delete(chatEntries, id)
+    for _, schedule := range schedules {
+        chatEntries[id] = append(chatEntries[id], scheduler.Schedule(schedule, cron.FuncJob(func() {
+            log.Println(fmt.Sprintf("Start cron job of %s.", id))
+            if err := pushDigest(id); err != nil {
+                log.Println(fmt.Sprintf(`Pushing digest to %s failed : "%s".`, id, err))
+            }
+        })))
+    }
+    return nil
+}
+
+func parseSchedule(spec string) (cron.Schedule, error) {
+    // Only minute hour day month weekday, descriptors like @every would allow anything
+    if strings.HasPrefix(spec, "@") || len(strings.Fields(spec)) != 5 {
+        return nil, errors.New("schedule must be 5 fields")
+    }
+    return cron.ParseStandard(spec)
+}
+
+func validSchedule(specs []string) error {
+    if len(specs) == 0 {
+        return errors.New("empty schedule")
+    }
+
+    // Upcoming runs of all specs together, since two specs can fire a minute apart
+    now := time.Now()
+    var runs []time.Time
+    for _, spec := range specs {
+        schedule, err := parseSchedule(spec)
+        if err != nil {
+            return err
+        }
+        next := now
+        for i := 0; i < checkedRuns; i++ {
+            next = schedule.Next(next)
+            if next.IsZero() {
+                break
+            }
+            runs = append(runs, next)
+        }
+    }
+    sort.Slice(runs, func(i, j int) bool { return runs[i].Before(runs[j]) })
+    for i := 1; i < len(runs); i++ {
+        if runs[i].Sub(runs[i-1]) < minScheduleInterval {
+            return errScheduleTooFrequent
+        }
+    }
+    return nil
+}
+
+func setSchedule(id string, specs []string) error {
+    // Stored first, the running schedule only changes once it will survive a restart
+    if err := validSchedule(specs); err != nil {
+        return err
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    if _, err = tx.Exec("delete from schedule where id = ?", id); err != nil {
+        return err
+    }
+    for _, spec := range specs {
+        if _, err = tx.Exec("insert into schedule (`id`, `spec`) values (?, ?)", id, spec); err != nil {
+            return err
+        }
+    }
+    if err = tx.Commit(); err != nil {
+        return err
+    }
+
+    return registerSchedule(id, specs)
+}
+
+func clearSchedule(id string) error {
+    if _, err := db.Exec("delete from schedule where id = ?", id); err != nil {
+        return err
+    }
+
+    chatEntriesLock.Lock()
+    defer chatEntriesLock.Unlock()
+    for _, entry := range chatEntries[id] {
+        scheduler.Remove(entry)
+    }
+    delete(chatEntries, id)
+    return nil
+}
+
+func replySchedule(id string) (string, error) {
+    rows, err := db.Query("select spec from schedule where id = ?", id)
+    if err != nil {
+        return "", err
+    }
+    defer rows.Close()
+    var specs []string
+    for rows.Next() {
+        var spec string
+        if err = rows.Scan(&spec); err != nil {
+            return "", err
+        }
+        specs = append(specs, spec)
+    }
+    if err = rows.Err(); err != nil {
+        return "", err
+    }
+
+    var response string
+    if len(specs) == 0 {
+        response = "您目前使用預設排程："
+        for _, spec := range strings.Split(os.Getenv("Crontab"), ";") {
+            if spec != "" {
+                specs = append(specs, spec)
+            }
+        }
+        if len(specs) == 0 {
+            return "您目前使用預設排程，預設排程沒有設定任何時間", nil
+        }
+    } else {
+        response = "您目前的排程："
+    }
+
+    now := time.Now()
+    for _, spec := range specs {
+        response += "\n" + spec
+        schedule, err := parseSchedule(spec)
+        if err != nil {
+            continue
+        }
+        next := now
+        for i := 0; i < upcomingRuns; i++ {
+            next = schedule.Next(next)
+            response += "\n  " + next.Format("2006-01-02 15:04")
+        }
+    }
+
+    return response, nil
+}
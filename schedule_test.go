@@ -0,0 +1,34 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestValidSchedule(t *testing.T) {
+    tests := []struct {
+        name  string
+        specs []string
+        err   bool
+    }{
+        {"daily", []string{"0 8 * * *"}, false},
+        {"hourly", []string{"0 * * * *"}, false},
+        {"twice a day", []string{"0 8 * * *", "30 17 * * *"}, false},
+        {"weekdays", []string{"0 9 * * 1-5"}, false},
+        {"every half hour", []string{"*/30 * * * *"}, true},
+        {"every minute", []string{"* * * * *"}, true},
+        {"two specs too close", []string{"0 8 * * *", "30 8 * * *"}, true},
+        {"same time twice", []string{"0 8 * * *", "0 8 * * *"}, true},
+        {"close across midnight", []string{"50 23 * * *", "10 0 * * *"}, true},
+        {"every descriptor", []string{"@every 1s"}, true},
+        {"hourly descriptor", []string{"@hourly"}, true},
+        {"with seconds", []string{"0 0 8 * * *"}, true},
+        {"malformed", []string{"0 25 * * *"}, true},
+        {"empty", []string{}, true},
+    }
+
+    for _, test := range tests {
+        if err := validSchedule(test.specs); (err != nil) != test.err {
+            t.Errorf("%s got %v, want error %v", test.name, err, test.err)
+        }
+    }
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "net"
+    "net/url"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/go-sql-driver/mysql"
+    _ "github.com/lib/pq"
+    _ "github.com/mattn/go-sqlite3"
+)
+
+// How Long A Ping Waits For The Remote Database
+const pingTimeout = 5 * time.Second
+
+// Driver Timeouts, So A Stalled Remote Database Fails Queries Instead Of Hanging Them
+const (
+    dialTimeout  = 5 * time.Second
+    queryTimeout = 30 * time.Second
+)
+
+// Orders Of Defects From A Source
+const (
+    orderNewest = iota // By time, newest first
+    orderOldest        // By time, oldest first
+    orderSeq           // By seq_id, as received
+)
+
+// Units Of Defect Counts Over Time
+const (
+    unitHour = "hour"
+    unitDay  = "day"
+)
+
+// Where Defects Are Read From, The recv And roadmark Tables
+type DefectSource interface {
+    // Defects calls each with defects matching query in order, skipping offset and stopping at limit if it's not 0
+    Defects(query DefectQuery, order int, limit int, offset int, each func(DefectDetail) error) error
+    // Defect returns the defect of seq regardless of its age, false if there's none
+    Defect(seq string) (DefectDetail, bool, error)
+    // CountDefects returns numbers of matching defects of each type, sorted by markid
+    CountDefects(query DefectQuery) ([]Defect, error)
+    // CountDefectsBy returns numbers of matching defects in each hour or day, keyed like 2006-01-02 15 or 2006-01-02
+    CountDefectsBy(query DefectQuery, unit string) (map[string]int, error)
+    // LatestSeq returns the largest seq_id of matching defects, empty if there's none
+    LatestSeq(query DefectQuery) (string, error)
+    // Roadmarks returns names of defect types by markid
+    Roadmarks() (map[string]string, error)
+    Ping() error
+}
+
+// SQL Differences Between Databases
+type sqlDialect struct {
+    timestamp string // Time of a defect
+    date      string // markdate as 2006-01-02
+    time      string // marktime as 15:04:05
+    latitude  string // GPS_y as a number
+    longitude string // GPS_x as a number
+    hour      string // Time of a defect as 2006-01-02 15
+    day       string // Time of a defect as 2006-01-02
+    numbered  bool   // Placeholders are $1, $2 instead of ?
+}
+
+var mysqlDialect = sqlDialect{
+    timestamp: `timestamp(markdate, marktime)`,
+    date:      `markdate`,
+    time:      `marktime`,
+    latitude:  `cast(GPS_y as decimal(10,7))`,
+    longitude: `cast(GPS_x as decimal(10,7))`,
+    hour:      `date_format(timestamp(markdate, marktime), '%Y-%m-%d %H')`,
+    day:       `date_format(markdate, '%Y-%m-%d')`,
+}
+
+var postgresDialect = sqlDialect{
+    timestamp: `(markdate + marktime)`,
+    date:      `to_char(markdate, 'YYYY-MM-DD')`,
+    time:      `to_char(marktime, 'HH24:MI:SS')`,
+    latitude:  `cast(GPS_y as double precision)`,
+    longitude: `cast(GPS_x as double precision)`,
+    hour:      `to_char(markdate + marktime, 'YYYY-MM-DD HH24')`,
+    day:       `to_char(markdate, 'YYYY-MM-DD')`,
+    numbered:  true,
+}
+
+var sqliteDialect = sqlDialect{
+    timestamp: `datetime(markdate || ' ' || marktime)`,
+    date:      `cast(markdate as text)`,
+    time:      `cast(marktime as text)`,
+    latitude:  `cast(GPS_y as real)`,
+    longitude: `cast(GPS_x as real)`,
+    hour:      `strftime('%Y-%m-%d %H', markdate || ' ' || marktime)`,
+    day:       `strftime('%Y-%m-%d', markdate)`,
+}
+
+type sqlSource struct {
+    db      *sql.DB
+    dialect sqlDialect
+}
+
+func newDefectSource() (DefectSource, error) {
+    driver := os.Getenv("DatabaseDriver")
+    host, user, password, name, port := os.Getenv("DatabaseHost"), os.Getenv("DatabaseUser"), os.Getenv("DatabasePassword"), os.Getenv("DatabaseName"), os.Getenv("DatabasePort")
+
+    var dsn string
+    var dialect sqlDialect
+    switch driver {
+    case "", "mysql":
+        driver, dialect = "mysql", mysqlDialect
+        if port == "" {
+            port = "3306"
+        }
+        config := mysql.NewConfig()
+        config.User, config.Passwd, config.DBName = user, password, name
+        config.Net, config.Addr = "tcp", net.JoinHostPort(host, port)
+        config.Timeout, config.ReadTimeout, config.WriteTimeout = dialTimeout, queryTimeout, queryTimeout
+        dsn = config.FormatDSN()
+    case "postgres":
+        dialect = postgresDialect
+        if port == "" {
+            port = "5432"
+        }
+        // A URL escapes whatever the password holds, TLS is required unless DatabaseSSLMode says otherwise
+        values := url.Values{}
+        values.Set("connect_timeout", strconv.Itoa(int(dialTimeout/time.Second)))
+        values.Set("statement_timeout", strconv.Itoa(int(queryTimeout/time.Millisecond))) // Run-time parameter, in milliseconds
+        if sslMode := os.Getenv("DatabaseSSLMode"); sslMode != "" {
+            values.Set("sslmode", sslMode)
+        }
+        dsn = (&url.URL{Scheme: "postgres", User: url.UserPassword(user, password), Host: net.JoinHostPort(host, port), Path: "/" + name, RawQuery: values.Encode()}).String()
+    case "sqlite3": // DatabaseName is the path of the file
+        dialect = sqliteDialect
+        dsn = "file:" + name + "?mode=ro"
+    default:
+        return nil, fmt.Errorf("unknown DatabaseDriver %s", driver)
+    }
+
+    db, err := sql.Open(driver, dsn)
+    if err != nil {
+        return nil, err
+    }
+    db.SetConnMaxLifetime(time.Minute * 3)
+    db.SetMaxOpenConns(10)
+    db.SetMaxIdleConns(10)
+    return &sqlSource{db: db, dialect: dialect}, nil
+}
+
+func (source *sqlSource) rebind(query string) string {
+    if !source.dialect.numbered {
+        return query
+    }
+    var rebound strings.Builder
+    n := 0
+    for _, char := range query {
+        if char == '?' {
+            n += 1
+            rebound.WriteString("$" + strconv.Itoa(n))
+            continue
+        }
+        rebound.WriteRune(char)
+    }
+    return rebound.String()
+}
+
+func (source *sqlSource) columns() string {
+    return fmt.Sprintf(`seq_id, markid, %s, %s, GPS_y, GPS_x, addr, photo_loc`, source.dialect.date, source.dialect.time)
+}
+
+func scanDefect(row interface{ Scan(...interface{}) error }) (DefectDetail, error) {
+    // Any column of recv may be NULL, which is read as empty
+    var columns [8]sql.NullString
+    err := row.Scan(&columns[0], &columns[1], &columns[2], &columns[3], &columns[4], &columns[5], &columns[6], &columns[7])
+    return DefectDetail{seq_id: columns[0].String, markid: columns[1].String, markdate: columns[2].String, marktime: columns[3].String, gps_y: columns[4].String, gps_x: columns[5].String, address: columns[6].String, photo: columns[7].String}, err
+}
+
+func (source *sqlSource) condition(query DefectQuery) (string, []interface{}) {
+    var conditions []string
+    var args []interface{}
+
+    // Period
+    if query.window != 0 {
+        now := time.Now().In(remoteZone)
+        conditions = append(conditions, source.dialect.timestamp+` between ? and ?`)
+        args = append(args, now.Add(-query.window).Format("2006-01-02 15:04:05"), now.Format("2006-01-02 15:04:05"))
+    } else if !query.from.IsZero() {
+        conditions = append(conditions, source.dialect.timestamp+` between ? and ?`)
+        args = append(args, query.from.Format("2006-01-02 15:04:05"), query.to.Format("2006-01-02 15:04:05"))
+    }
+
+    // Watermark
+    if query.after != "" {
+        conditions = append(conditions, `seq_id > ?`)
+        args = append(args, query.after)
+    }
+    if query.until != "" {
+        conditions = append(conditions, `seq_id <= ?`)
+        args = append(args, query.until)
+    }
+
+    // Address
+    if query.keyword != "" {
+        conditions = append(conditions, `addr like ?`)
+        args = append(args, "%"+query.keyword+"%")
+    }
+
+    // Types
+    if !contains(query.markids, "all") {
+        conditions = append(conditions, `markid in (?`+strings.Repeat(",?", len(query.markids)-1)+`)`)
+        for _, markid := range query.markids {
+            args = append(args, markid)
+        }
+    }
+
+    // Area, the bounding box only, exact shape is checked by inArea
+    if query.area != nil {
+        minLat, maxLat, minLng, maxLng := query.area.bounds()
+        conditions = append(conditions, source.dialect.latitude+` between ? and ? and `+source.dialect.longitude+` between ? and ?`)
+        args = append(args, minLat, maxLat, minLng, maxLng)
+    }
+
+    if len(conditions) == 0 {
+        conditions = append(conditions, `1 = 1`)
+    }
+    return strings.Join(conditions, " and "), args
+}
+
+func (source *sqlSource) Defects(query DefectQuery, order int, limit int, offset int, each func(DefectDetail) error) error {
+    condition, args := source.condition(query)
+
+    // Page, after the last defect of the previous one
+    if parts := strings.SplitN(query.cursor, "_", 2); len(parts) == 2 {
+        condition += ` and (` + source.dialect.timestamp + ` < ? or (` + source.dialect.timestamp + ` = ? and seq_id < ?))`
+        args = append(args, parts[0], parts[0], parts[1])
+    }
+
+    statement := `select ` + source.columns() + ` from recv where ` + condition
+    switch order {
+    case orderNewest:
+        statement += ` order by ` + source.dialect.timestamp + ` desc, seq_id desc`
+    case orderOldest:
+        statement += ` order by ` + source.dialect.timestamp + `, seq_id`
+    default:
+        statement += ` order by seq_id`
+    }
+    if query.area == nil && limit > 0 { // Areas are filtered after fetching, so do the paging there
+        statement += ` limit ? offset ?`
+        args = append(args, limit, offset)
+        offset = 0
+    }
+
+    rows, err := source.db.Query(source.rebind(statement), args...)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    passed := 0
+    for rows.Next() && (limit == 0 || passed < limit) {
+        defectDetail, err := scanDefect(rows)
+        if err != nil {
+            return err
+        }
+        if !inArea(query.area, defectDetail.gps_y, defectDetail.gps_x) {
+            continue
+        }
+        if offset > 0 {
+            offset -= 1
+            continue
+        }
+        if err = each(defectDetail); err != nil {
+            return err
+        }
+        passed += 1
+    }
+    return rows.Err()
+}
+
+func (source *sqlSource) Defect(seq string) (DefectDetail, bool, error) {
+    defectDetail, err := scanDefect(source.db.QueryRow(source.rebind(`select `+source.columns()+` from recv where seq_id = ?`), seq))
+    if err == sql.ErrNoRows {
+        return defectDetail, false, nil
+    }
+    return defectDetail, err == nil, err
+}
+
+func (source *sqlSource) CountDefects(query DefectQuery) ([]Defect, error) {
+    nums, err := source.count(query, `markid`)
+    if err != nil {
+        return nil, err
+    }
+    defects := []Defect{}
+    for markid, num := range nums {
+        defects = append(defects, Defect{markid: markid, num: num})
+    }
+    sort.Slice(defects, func(i, j int) bool { return defects[i].markid < defects[j].markid })
+    return defects, nil
+}
+
+func (source *sqlSource) CountDefectsBy(query DefectQuery, unit string) (map[string]int, error) {
+    if unit == unitHour {
+        return source.count(query, source.dialect.hour)
+    }
+    return source.count(query, source.dialect.day)
+}
+
+func (source *sqlSource) count(query DefectQuery, key string) (map[string]int, error) {
+    condition, args := source.condition(query)
+    nums := map[string]int{}
+
+    if query.area != nil { // Count defects inside the area
+        rows, err := source.db.Query(source.rebind(`select `+key+`, GPS_y, GPS_x from recv where `+condition), args...)
+        if err != nil {
+            return nil, err
+        }
+        defer rows.Close()
+        for rows.Next() {
+            var group, gpsY, gpsX sql.NullString
+            if err = rows.Scan(&group, &gpsY, &gpsX); err != nil {
+                return nil, err
+            }
+            if inArea(query.area, gpsY.String, gpsX.String) {
+                nums[group.String] += 1
+            }
+        }
+        return nums, rows.Err()
+    }
+
+    rows, err := source.db.Query(source.rebind(`select `+key+`, count(*) from recv where `+condition+` group by `+key), args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var group sql.NullString
+        var num int
+        if err = rows.Scan(&group, &num); err != nil {
+            return nil, err
+        }
+        nums[group.String] = num
+    }
+    return nums, rows.Err()
+}
+
+func (source *sqlSource) LatestSeq(query DefectQuery) (string, error) {
+    condition, args := source.condition(query)
+
+    if query.area != nil { // Latest defect inside the area
+        rows, err := source.db.Query(source.rebind(`select seq_id, GPS_y, GPS_x from recv where `+condition), args...)
+        if err != nil {
+            return "", err
+        }
+        defer rows.Close()
+
+        latest := ""
+        for rows.Next() {
+            var seq, gpsY, gpsX sql.NullString
+            if err = rows.Scan(&seq, &gpsY, &gpsX); err != nil {
+                return "", err
+            }
+            if inArea(query.area, gpsY.String, gpsX.String) {
+                latest = laterSeq(seq.String, latest)
+            }
+        }
+        return latest, rows.Err()
+    }
+
+    var latest sql.NullString
+    err := source.db.QueryRow(source.rebind(`select max(seq_id) from recv where `+condition), args...).Scan(&latest)
+    return latest.String, err
+}
+
+func (source *sqlSource) Roadmarks() (map[string]string, error) {
+    rows, err := source.db.Query("select * from roadmark")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    names := make(map[string]string)
+    for rows.Next() {
+        var markid, name sql.NullString
+        if err = rows.Scan(&markid, &name); err != nil {
+            return nil, err
+        }
+        roadmark := Roadmark{markid: markid.String, name: name.String}
+        names[roadmark.markid] = roadmark.name
+    }
+    return names, rows.Err()
+}
+
+func (source *sqlSource) Ping() error {
+    // An unreachable host would otherwise hang until the OS gives up dialing
+    ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+    defer cancel()
+    return source.db.PingContext(ctx)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+    "database/sql"
+    "io/ioutil"
+    "path/filepath"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func fixtureSource(t *testing.T) DefectSource {
+    path := filepath.Join(t.TempDir(), "recv.db")
+    fixture, err := ioutil.ReadFile(filepath.Join("testdata", "recv.sql"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    conn, err := sql.Open("sqlite3", path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err = conn.Exec(string(fixture)); err != nil {
+        t.Fatal(err)
+    }
+    conn.Close()
+
+    t.Setenv("DatabaseDriver", "sqlite3")
+    t.Setenv("DatabaseName", path)
+    source, err := newDefectSource()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err = source.Ping(); err != nil {
+        t.Fatal(err)
+    }
+    return source
+}
+
+// Period Of The Fixture, Leaving Out Seq 7 And 8
+func fixtureQuery(markids ...string) DefectQuery {
+    from := time.Date(2026, 10, 1, 0, 0, 0, 0, remoteZone)
+    return DefectQuery{markids: markids, from: from, to: from.AddDate(0, 0, 4).Add(-time.Second), page: 1}
+}
+
+func fixtureArea() *Geofence {
+    return &Geofence{kind: "near", lat: 25.0478, lng: 121.5170, radius: 500}
+}
+
+func collectSeqs(t *testing.T, source DefectSource, query DefectQuery, order int, limit int, offset int) ([]string, DefectDetail) {
+    /*
+       []string : seq_id of each defect
+       DefectDetail : the last defect, to page after it
+    */
+
+    seqs := []string{}
+    var last DefectDetail
+    err := source.Defects(query, order, limit, offset, func(defectDetail DefectDetail) error {
+        seqs = append(seqs, defectDetail.seq_id)
+        last = defectDetail
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    return seqs, last
+}
+
+func TestSQLiteSourceDefects(t *testing.T) {
+    source := fixtureSource(t)
+
+    seqs, _ := collectSeqs(t, source, fixtureQuery("all"), orderSeq, 0, 0)
+    if want := []string{"1", "2", "3", "4", "5", "6"}; !reflect.DeepEqual(seqs, want) {
+        t.Errorf("period got %v, want %v", seqs, want)
+    }
+    seqs, _ = collectSeqs(t, source, fixtureQuery("D20", "D30"), orderOldest, 0, 0)
+    if want := []string{"2", "5"}; !reflect.DeepEqual(seqs, want) {
+        t.Errorf("markids got %v, want %v", seqs, want)
+    }
+
+    // Pages by cursor, defects of the same time are ordered by seq_id
+    query := fixtureQuery("all")
+    var pages [][]string
+    for i := 0; i < 4; i++ {
+        seqs, last := collectSeqs(t, source, query, orderNewest, 2, 0)
+        pages = append(pages, seqs)
+        query.cursor = last.markdate + " " + last.marktime + "_" + last.seq_id
+    }
+    if want := [][]string{{"6", "5"}, {"4", "3"}, {"2", "1"}, {}}; !reflect.DeepEqual(pages, want) {
+        t.Errorf("cursor pages got %v, want %v", pages, want)
+    }
+
+    // Pages inside an area, which is filtered after fetching
+    query = fixtureQuery("all")
+    query.area = fixtureArea()
+    pages = nil
+    for page := 0; page < 3; page++ {
+        seqs, _ := collectSeqs(t, source, query, orderNewest, 2, page*2)
+        pages = append(pages, seqs)
+    }
+    if want := [][]string{{"6", "4"}, {"2", "1"}, {}}; !reflect.DeepEqual(pages, want) {
+        t.Errorf("area pages got %v, want %v", pages, want)
+    }
+    query.cursor = "2026-10-02 10:00:00_4"
+    seqs, _ = collectSeqs(t, source, query, orderNewest, 2, 0)
+    if want := []string{"2", "1"}; !reflect.DeepEqual(seqs, want) {
+        t.Errorf("area cursor got %v, want %v", seqs, want)
+    }
+
+    // NULL columns are read as empty
+    defectDetail, ok, err := source.Defect("5")
+    if err != nil || !ok || defectDetail.gps_y != "" || defectDetail.address != "" || defectDetail.markdate != "2026-10-02" {
+        t.Errorf("defect 5 got %+v, %v, %v", defectDetail, ok, err)
+    }
+}
+
+func TestSQLiteSourceCounts(t *testing.T) {
+    source := fixtureSource(t)
+
+    defects, err := source.CountDefects(fixtureQuery("all"))
+    if want := []Defect{{markid: "D10", num: 4}, {markid: "D20", num: 1}, {markid: "D30", num: 1}}; err != nil || !reflect.DeepEqual(defects, want) {
+        t.Errorf("counts got %v, %v, want %v", defects, err, want)
+    }
+    query := fixtureQuery("all")
+    query.area = fixtureArea()
+    defects, err = source.CountDefects(query)
+    if want := []Defect{{markid: "D10", num: 3}, {markid: "D20", num: 1}}; err != nil || !reflect.DeepEqual(defects, want) {
+        t.Errorf("area counts got %v, %v, want %v", defects, err, want)
+    }
+
+    days, err := source.CountDefectsBy(fixtureQuery("all"), unitDay)
+    if want := map[string]int{"2026-10-01": 3, "2026-10-02": 2, "2026-10-03": 1}; err != nil || !reflect.DeepEqual(days, want) {
+        t.Errorf("days got %v, %v, want %v", days, err, want)
+    }
+    hours, err := source.CountDefectsBy(fixtureQuery("D10"), unitHour)
+    if want := map[string]int{"2026-10-01 08": 1, "2026-10-01 09": 1, "2026-10-02 10": 1, "2026-10-03 23": 1}; err != nil || !reflect.DeepEqual(hours, want) {
+        t.Errorf("hours got %v, %v, want %v", hours, err, want)
+    }
+}
+
+func TestSQLiteSourceLatestSeq(t *testing.T) {
+    source := fixtureSource(t)
+
+    tests := []struct {
+        name  string
+        query DefectQuery
+        want  string
+    }{
+        {"all time", DefectQuery{markids: []string{"all"}}, "8"},
+        {"period", fixtureQuery("all"), "6"},
+        {"markids", fixtureQuery("D20"), "2"},
+        {"until", DefectQuery{markids: []string{"all"}, until: "4"}, "4"},
+        {"none", DefectQuery{markids: []string{"all"}, after: "8"}, ""},
+    }
+    for _, test := range tests {
+        latest, err := source.LatestSeq(test.query)
+        if err != nil || latest != test.want {
+            t.Errorf("%s got %q, %v, want %q", test.name, latest, err, test.want)
+        }
+    }
+}
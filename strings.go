@@ -2,15 +2,43 @@ package main
 
 var _version string = "1.1.0"
 
-var _help string = `sub <mark_ids> - 訂閱缺陷種類，以收到排程訊息。參數留空為訂閱全部
-unsub <all | mark_ids> - 取消訂閱缺陷種類。參數留空為取消訂閱全部，參數all為刪除所有記錄
-list - 顯示目前訂閱狀況
-summary <all | mark_ids> - 手動調閱彙整資料。參數留空為調閱已訂閱的缺陷彙整資料，參數all為調閱所有缺陷之彙整資料
-inspect <all | mark_ids> - 手動調閱詳細資料。參數留空為調閱已訂閱的缺陷詳細資料，參數all為調閱所有缺陷之詳細資料
+var _welcome string = `感謝您加入道路缺陷通報機器人！
+訂閱缺陷種類後，將依排程收到缺陷通知，以下為指令說明`
+
+var _failure string = `處理失敗，請稍後再試`
+
+var _databaseUnavailable string = `資料庫暫時無法連線`
+
+var _quickstart string = `請點選下方按鈕訂閱缺陷種類，或輸入sub訂閱全部`
+
+var _help string = `sub <mark_ids> [area] - 訂閱缺陷種類，以收到排程訊息。參數留空為訂閱全部，加上area則只收到該區域內的缺陷，區域套用於所有訂閱，每個對話只能有一個區域
+unsub <all | mark_ids | area> - 取消訂閱缺陷種類。參數留空為取消訂閱全部，參數all為刪除所有記錄，參數area為取消訂閱區域
+list - 顯示目前訂閱狀況，可點選下方按鈕快速訂閱或取消訂閱
+summary <all | mark_ids> [period] [area] - 手動調閱彙整資料。參數留空為調閱已訂閱的缺陷彙整資料，參數all為調閱所有缺陷之彙整資料
+inspect <all | mark_ids> [period] [area] [page N] - 手動調閱詳細資料。參數留空為調閱已訂閱的缺陷詳細資料，參數all為調閱所有缺陷之詳細資料
+inspect new - 調閱上次查看或推送後新增的已訂閱缺陷詳細資料
+search <keyword> [all | mark_ids] [period] [area] - 搜尋地址包含關鍵字的缺陷詳細資料。例如：search 中山北路二段 D10 1d
+detail <seq_id> - 調閱單筆缺陷的完整資料及附近的其他缺陷，不限時間。也可點選詳細資料中的編號
+trend <all | mark_ids> [period] [area] - 以圖表顯示每小時或每日的缺陷通報數。參數留空為已訂閱的缺陷，period留空為7d，兩天內以小時計。例如：trend D10 30d
+export <all | mark_ids> [period] [area] [xlsx | csv] - 取得缺陷資料的下載連結，預設為xlsx。例如：export all 2026-10-01..2026-10-31
+schedule set <cron> - 設定此對話專屬的推送排程，格式為：分 時 日 月 星期，多組排程可用;分開，推送間隔不可少於1小時。例如：schedule set 0 8,17 * * 1-5
+schedule list - 顯示目前的推送排程及接下來的推送時間
+schedule clear - 清除專屬排程，改用預設排程
 leave - 離開群聊或群組
 getid - 獲取當前對話的ID，可利用於手動觸發
 version - 顯示機器人版本
 
+傳送位置訊息可查看附近最近新增的缺陷，依距離由近至遠排列
+
 mark_ids格式為D開頭接兩位數字，批量操作可用空白分開。例如：D00 D11 D22
 
-因LINE限制，inspect最多顯示11筆詳細資料`
+period為調閱的時間範圍，留空為預設範圍。可為數字接m(分鐘)、h(小時)或d(天)，例如：30m 3h 1d
+也可為日期區間，例如：today yesterday 2026-10-01 2026-10-01..2026-10-07 2026-10-01T08:00..2026-10-01T17:00
+
+area為地區範圍，可為near 緯度,經度 [半徑]或in 區域名稱。例如：near 25.0330,121.5654 500m、in 中正區
+半徑可為數字接m(公尺)或km(公里)，留空為500m。每個對話只能訂閱一個區域，訂閱後所有推送及調閱都只會顯示區域內的資料，指令中另外指定area時則以指定的為準
+
+因LINE限制，inspect每頁最多顯示11筆詳細資料，可點選最後一筆的下一頁或以page N查看其他頁`
+
+var _adminHelp string = `quarantine list - 顯示因推送失敗而被隔離的對話
+quarantine restore <all | ids> - 恢復被隔離的對話，參數all為恢復全部`
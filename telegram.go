@@ -0,0 +1,117 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "html"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "time"
+)
+
+// Default Telegram Bot API, TelegramAPI Overrides It For Local Stand-ins
+const defaultTelegramAPI = "https://api.telegram.org"
+
+// Maximum Length Of A Telegram Message
+const telegramMessageLimit = 4096
+
+var telegramClient = &http.Client{Timeout: 10 * time.Second}
+
+// Error Returned By The Telegram Bot API
+type TelegramError struct {
+    Code        int
+    Description string
+}
+
+func (err *TelegramError) Error() string {
+    return fmt.Sprintf("telegram: %d %s", err.Code, err.Description)
+}
+
+type telegramNotifier struct{}
+
+func (telegramNotifier) Push(id string, report Report, skipEmpty bool) (bool, error) {
+    data, err := retriveReportData(id, report)
+    if err != nil {
+        return false, err
+    }
+    if skipEmpty && report.text == "" && data.total == 0 {
+        return false, nil
+    }
+
+    err = sendTelegram(strings.TrimPrefix(id, telegramPrefix), renderTelegram(report, data))
+    recordDelivery(id, err)
+    return true, err
+}
+
+func sendTelegram(chatID string, text string) error {
+    token := os.Getenv("TelegramBotToken")
+    if token == "" {
+        return fmt.Errorf("TelegramBotToken is not set")
+    }
+    api := os.Getenv("TelegramAPI")
+    if api == "" {
+        api = defaultTelegramAPI
+    }
+
+    response, err := telegramClient.PostForm(fmt.Sprintf("%s/bot%s/sendMessage", strings.TrimSuffix(api, "/"), token), url.Values{
+        "chat_id":                  {chatID},
+        "text":                     {text},
+        "parse_mode":               {"HTML"},
+        "disable_web_page_preview": {"true"},
+    })
+    if err != nil {
+        return err
+    }
+    defer response.Body.Close()
+
+    var result struct {
+        Ok          bool   `json:"ok"`
+        ErrorCode   int    `json:"error_code"`
+        Description string `json:"description"`
+    }
+    if err = json.NewDecoder(response.Body).Decode(&result); err != nil {
+        return &TelegramError{Code: response.StatusCode, Description: "invalid response"}
+    }
+    if !result.Ok {
+        return &TelegramError{Code: result.ErrorCode, Description: result.Description}
+    }
+    return nil
+}
+
+func renderTelegram(report Report, data reportData) string {
+    var text strings.Builder
+    if report.header != "" {
+        text.WriteString(html.EscapeString(report.header) + "\n\n")
+    }
+    if report.text != "" {
+        text.WriteString(html.EscapeString(report.text))
+        return text.String()
+    }
+
+    text.WriteString(fmt.Sprintf("<b>%s</b>\n<i>%s</i>\n", html.EscapeString(report.title), html.EscapeString(formatCondition(report.query))))
+    if data.total == 0 {
+        text.WriteString("沒有任何資料")
+        return text.String()
+    }
+    for _, defect := range data.defects {
+        text.WriteString(fmt.Sprintf("%s：%d筆\n", html.EscapeString(formatDefectType(defect.markid)), defect.num))
+    }
+
+    shown := 0
+    for _, defectDetail := range data.details {
+        _, photoUri := photoURIs(defectDetail)
+        item := fmt.Sprintf("\n<b>%s</b> %s %s #%s\n%s\n<a href=\"%s\">照片</a> <a href=\"http://www.google.com/maps/place/%s,%s\">地圖</a>\n",
+            html.EscapeString(formatDefectType(defectDetail.markid)), html.EscapeString(defectDetail.markdate), html.EscapeString(defectDetail.marktime), html.EscapeString(defectDetail.seq_id), html.EscapeString(defectDetail.address), html.EscapeString(photoUri), html.EscapeString(defectDetail.gps_y), html.EscapeString(defectDetail.gps_x))
+        if len([]rune(text.String()+item)) > telegramMessageLimit-64 { // Leave room for the note below
+            break
+        }
+        text.WriteString(item)
+        shown += 1
+    }
+    if shown < data.total && len(data.details) > 0 {
+        text.WriteString(fmt.Sprintf("\n僅列出前%d筆，共%d筆", shown, data.total))
+    }
+    return text.String()
+}
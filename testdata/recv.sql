@@ -0,0 +1,25 @@
+-- Defects around Taipei Main Station, read by source_test.go through the sqlite3 driver
+CREATE TABLE "recv" (
+    "seq_id"	integer PRIMARY KEY,
+    "markid"	varchar(3),
+    "markdate"	date,
+    "marktime"	time,
+    "GPS_y"	varchar(16),
+    "GPS_x"	varchar(16),
+    "addr"	varchar(128),
+    "photo_loc"	varchar(64)
+);
+CREATE TABLE "roadmark" (
+    "markid"	varchar(3),
+    "name"	varchar(16)
+);
+INSERT INTO "roadmark" VALUES ('D10', '坑洞'), ('D20', '龜裂'), ('D30', '人孔高差');
+INSERT INTO "recv" VALUES
+    (1, 'D10', '2026-10-01', '08:00:00', '25.0478', '121.5170', '臺北市中正區忠孝西路一段49號', '1.jpg'),
+    (2, 'D20', '2026-10-01', '09:30:00', '25.0480', '121.5172', '臺北市中正區忠孝西路一段50號', '2.jpg'),
+    (3, 'D10', '2026-10-01', '09:30:00', '25.0330', '121.5654', '臺北市信義區信義路五段7號', '3.jpg'),
+    (4, 'D10', '2026-10-02', '10:00:00', '25.0470', '121.5165', '臺北市中正區館前路2號', '4.jpg'),
+    (5, 'D30', '2026-10-02', '10:00:00', NULL, NULL, NULL, '5.jpg'),
+    (6, 'D10', '2026-10-03', '23:59:59', '25.0479', '121.5171', '臺北市中正區忠孝西路一段49號', '6.jpg'),
+    (7, 'D20', '2026-10-05', '12:00:00', '25.0475', '121.5168', '臺北市中正區館前路8號', '7.jpg'),
+    (8, 'D10', '2026-09-30', '23:00:00', '25.0478', '121.5170', '臺北市中正區忠孝西路一段49號', '8.jpg');
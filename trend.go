@@ -0,0 +1,343 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "image"
+    "image/color"
+    "image/draw"
+    "image/png"
+    "log"
+    "math"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/line/line-bot-sdk-go/v7/linebot"
+)
+
+// Period Charted When trend Omits It
+const defaultTrendWindow = 7 * 24 * time.Hour
+
+// Longest Period Charted Per Hour, Longer Ones Are Charted Per Day
+const hourlyTrendLimit = 48 * time.Hour
+
+// Maximum Bars In One Chart
+const maxTrendBuckets = 92
+
+// Returned By trend When The Period Needs More Bars Than maxTrendBuckets
+var errTooManyBuckets = fmt.Errorf("more than %d buckets", maxTrendBuckets)
+
+// Size Of Rendered Charts, In Pixels
+const (
+    chartWidth  = 800
+    chartHeight = 450
+)
+
+// How Long A Chart Link Stays Valid, Charts Are Rendered Again Each Time It's Fetched
+const chartLinkTTL = 24 * time.Hour
+
+type TrendBucket struct {
+    start time.Time
+    label string
+    count int
+}
+
+func trend(id string, query DefectQuery) ([]TrendBucket, string, error) {
+    /*
+       []TrendBucket : defect counts of each hour or day in the period
+       string : "hour" or "day"
+    */
+
+    to := query.to
+    from := query.from
+    if query.window != 0 {
+        to = time.Now().In(remoteZone)
+        from = to.Add(-query.window)
+    }
+
+    unit, step := unitDay, 24*time.Hour
+    start := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, remoteZone)
+    if to.Sub(from) <= hourlyTrendLimit {
+        unit, step = unitHour, time.Hour
+        start = from.Truncate(time.Hour)
+    }
+
+    var buckets []TrendBucket
+    for t := start; !t.After(to); t = t.Add(step) {
+        if len(buckets) == maxTrendBuckets {
+            return nil, unit, errTooManyBuckets
+        }
+        bucket := TrendBucket{start: t, label: t.Format("01-02")}
+        if unit == unitHour && (t.Hour() != 0 || len(buckets) == 0) {
+            bucket.label = t.Format("15:04")
+        }
+        buckets = append(buckets, bucket)
+    }
+
+    counts, err := retriveTrendCounts(id, query, unit)
+    if err != nil {
+        return nil, unit, err
+    }
+    for i := range buckets {
+        if unit == unitHour {
+            buckets[i].count = counts[buckets[i].start.Format("2006-01-02 15")]
+        } else {
+            buckets[i].count = counts[buckets[i].start.Format("2006-01-02")]
+        }
+    }
+
+    return buckets, unit, nil
+}
+
+func retriveTrendCounts(id string, query DefectQuery, unit string) (map[string]int, error) {
+    /*
+       map[string]int : key is the hour or day formatted like 2006-01-02 15 or 2006-01-02, value is the number of defects
+    */
+
+    query, ok, err := resolveQuery(id, query)
+    if !ok {
+        return map[string]int{}, err
+    }
+
+    return source.CountDefectsBy(query, unit)
+}
+
+func formatTrend(query DefectQuery, buckets []TrendBucket, unit string) string {
+    var types string
+    if len(query.markids) == 0 {
+        types = "已訂閱缺陷"
+    } else if contains(query.markids, "all") {
+        types = "所有缺陷"
+    } else {
+        types = strings.Join(query.markids, " ")
+    }
+    unitName := "每日"
+    if unit == "hour" {
+        unitName = "每小時"
+    }
+
+    total, peak := 0, 0
+    for i, bucket := range buckets {
+        total += bucket.count
+        if bucket.count > buckets[peak].count {
+            peak = i
+        }
+    }
+    response := fmt.Sprintf("%s %s %s通報數", types, formatPeriod(query), unitName)
+    if query.area != nil {
+        response += "，區域" + query.area.describe()
+    }
+    if total == 0 {
+        return response + "\n沒有任何資料"
+    }
+    if unit == "hour" {
+        response += fmt.Sprintf("\n合計%d筆，最多為%s共%d筆", total, buckets[peak].start.Format("2006-01-02 15:04"), buckets[peak].count)
+    } else {
+        response += fmt.Sprintf("\n合計%d筆，最多為%s共%d筆", total, buckets[peak].start.Format("2006-01-02"), buckets[peak].count)
+    }
+
+    // Compare the later half with the earlier half
+    half := len(buckets) / 2
+    earlier, later := 0, 0
+    for i, bucket := range buckets {
+        if i < half {
+            earlier += bucket.count
+        } else if i >= len(buckets)-half {
+            later += bucket.count
+        }
+    }
+    switch {
+    case half == 0:
+    case earlier == 0 && later > 0:
+        response += "\n後半段較前半段增加"
+    case earlier > 0 && later > earlier:
+        response += fmt.Sprintf("\n後半段較前半段增加%.0f%%", float64(later-earlier)/float64(earlier)*100)
+    case earlier > 0 && later < earlier:
+        response += fmt.Sprintf("\n後半段較前半段減少%.0f%%", float64(earlier-later)/float64(earlier)*100)
+    default:
+        response += "\n後半段與前半段持平"
+    }
+    return response
+}
+
+func renderTrend(query DefectQuery, buckets []TrendBucket, unit string) ([]byte, error) {
+    img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+    draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+    gridColor := color.RGBA{0xe0, 0xe0, 0xe0, 0xff}
+    axisColor := color.RGBA{0x55, 0x55, 0x55, 0xff}
+    labelColor := color.RGBA{0x8c, 0x8c, 0x8c, 0xff}
+    barColor := color.RGBA{0x06, 0xc7, 0x55, 0xff}
+    const left, right, top, bottom = 70, 20, 40, 50
+    plot := image.Rect(left, top, chartWidth-right, chartHeight-bottom)
+
+    // Y axis, four steps rounded to 1, 2 or 5
+    peak := 0
+    for _, bucket := range buckets {
+        if bucket.count > peak {
+            peak = bucket.count
+        }
+    }
+    step := niceStep(float64(peak) / 4)
+    ceiling := step * 4
+    for i := 0; i <= 4; i++ {
+        y := plot.Max.Y - int(float64(plot.Dy())*float64(i)/4)
+        fillRect(img, image.Rect(plot.Min.X, y, plot.Max.X, y+1), gridColor)
+        label := fmt.Sprint(int(step) * i)
+        drawText(img, plot.Min.X-10-textWidth(label), y-glyphHeight/2, label, labelColor)
+    }
+
+    // Bars and X axis labels
+    slot := float64(plot.Dx()) / float64(len(buckets))
+    barWidth := int(math.Max(1, slot*0.7))
+    labelEvery := int(math.Ceil(float64(len(buckets)) * float64(textWidth("00-00")+12) / float64(plot.Dx())))
+    for i, bucket := range buckets {
+        x := plot.Min.X + int(slot*float64(i)+(slot-float64(barWidth))/2)
+        height := int(float64(plot.Dy()) * float64(bucket.count) / ceiling)
+        fillRect(img, image.Rect(x, plot.Max.Y-height, x+barWidth, plot.Max.Y), barColor)
+        if count := fmt.Sprint(bucket.count); bucket.count > 0 && textWidth(count) <= int(slot) {
+            drawText(img, x+barWidth/2-textWidth(count)/2, plot.Max.Y-height-glyphHeight-4, count, axisColor)
+        }
+        if i%labelEvery == 0 {
+            drawText(img, x+barWidth/2-textWidth(bucket.label)/2, plot.Max.Y+12, bucket.label, labelColor)
+        }
+    }
+    fillRect(img, image.Rect(plot.Min.X, plot.Max.Y, plot.Max.X, plot.Max.Y+2), axisColor)
+
+    // Axis titles and legend, the bitmap font only has ASCII
+    drawText(img, 10, 8, "DEFECTS", axisColor)
+    xTitle := "DATE (MM-DD)"
+    if unit == unitHour {
+        xTitle = "HOUR (HH:MM)"
+    }
+    drawText(img, plot.Min.X+plot.Dx()/2-textWidth(xTitle)/2, plot.Max.Y+32, xTitle, axisColor)
+    legend := "SUBSCRIBED"
+    if contains(query.markids, "all") {
+        legend = "ALL"
+    } else if len(query.markids) > 0 {
+        legend = strings.Join(query.markids, " ")
+    }
+    legend += " PER " + strings.ToUpper(unit)
+    legendX := plot.Max.X - textWidth(legend)
+    fillRect(img, image.Rect(legendX-glyphHeight-6, 8, legendX-6, 8+glyphHeight), barColor)
+    drawText(img, legendX, 8, legend, labelColor)
+
+    var buffer bytes.Buffer
+    if err := png.Encode(&buffer, img); err != nil {
+        return nil, err
+    }
+    return buffer.Bytes(), nil
+}
+
+func niceStep(raw float64) float64 {
+    if raw <= 1 {
+        return 1
+    }
+    magnitude := math.Pow(10, math.Floor(math.Log10(raw)))
+    for _, factor := range []float64{1, 2, 5, 10} {
+        if factor*magnitude >= raw {
+            return factor * magnitude
+        }
+    }
+    return 10 * magnitude
+}
+
+func fillRect(img *image.RGBA, rect image.Rectangle, c color.Color) {
+    draw.Draw(img, rect, image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+// Digits, Capital Letters And Separators In A 3x5 Bitmap, One Row Per Byte
+var glyphs = map[rune][5]uint8{
+    '0': {7, 5, 5, 5, 7}, '1': {2, 6, 2, 2, 7}, '2': {7, 1, 7, 4, 7}, '3': {7, 1, 7, 1, 7},
+    '4': {5, 5, 7, 1, 1}, '5': {7, 4, 7, 1, 7}, '6': {7, 4, 7, 5, 7}, '7': {7, 1, 1, 1, 1},
+    '8': {7, 5, 7, 5, 7}, '9': {7, 5, 7, 1, 7}, '-': {0, 0, 7, 0, 0}, ':': {0, 2, 0, 2, 0},
+    '(': {1, 2, 2, 2, 1}, ')': {4, 2, 2, 2, 4},
+    'A': {2, 5, 7, 5, 5}, 'B': {6, 5, 6, 5, 6}, 'C': {3, 4, 4, 4, 3}, 'D': {6, 5, 5, 5, 6},
+    'E': {7, 4, 6, 4, 7}, 'F': {7, 4, 6, 4, 4}, 'G': {3, 4, 5, 5, 3}, 'H': {5, 5, 7, 5, 5},
+    'I': {7, 2, 2, 2, 7}, 'J': {1, 1, 1, 5, 2}, 'K': {5, 5, 6, 5, 5}, 'L': {4, 4, 4, 4, 7},
+    'M': {5, 7, 7, 5, 5}, 'N': {6, 5, 5, 5, 5}, 'O': {2, 5, 5, 5, 2}, 'P': {6, 5, 6, 4, 4},
+    'Q': {2, 5, 5, 6, 3}, 'R': {6, 5, 6, 5, 5}, 'S': {3, 4, 2, 1, 6}, 'T': {7, 2, 2, 2, 2},
+    'U': {5, 5, 5, 5, 7}, 'V': {5, 5, 5, 5, 2}, 'W': {5, 5, 7, 7, 5}, 'X': {5, 5, 2, 5, 5},
+    'Y': {5, 5, 2, 2, 2}, 'Z': {7, 1, 2, 4, 7},
+}
+
+// Scale Of Glyphs When Drawn
+const (
+    glyphScale  = 3
+    glyphWidth  = 3 * glyphScale
+    glyphHeight = 5 * glyphScale
+    glyphGap    = glyphScale
+)
+
+func textWidth(text string) int {
+    return len(text)*(glyphWidth+glyphGap) - glyphGap
+}
+
+func drawText(img *image.RGBA, x int, y int, text string, c color.Color) {
+    for _, char := range text {
+        for row, bits := range glyphs[char] {
+            for col := 0; col < 3; col++ {
+                if bits&(4>>col) != 0 {
+                    fillRect(img, image.Rect(x+col*glyphScale, y+row*glyphScale, x+(col+1)*glyphScale, y+(row+1)*glyphScale), c)
+                }
+            }
+        }
+        x += glyphWidth + glyphGap
+    }
+}
+
+func chartLink(id string, query DefectQuery) string {
+    if query.window != 0 { // Fix the period at the time the link is made
+        query.to = time.Now().In(remoteZone)
+        query.from, query.window = query.to.Add(-query.window), 0
+    }
+    values := encodeQuery(query)
+    values.Set("id", id)
+    values.Set("expires", strconv.FormatInt(time.Now().Add(chartLinkTTL).Unix(), 10))
+    values.Set("sig", linkSignature(values))
+    return strings.TrimSuffix(os.Getenv("PublicURL"), "/") + "/chart.png?" + values.Encode()
+}
+
+func chartHandler(w http.ResponseWriter, r *http.Request) {
+    // Charts aren't kept, the signed link has all it takes to draw one again
+    values := r.URL.Query()
+    if !verifySignedLink(values) {
+        http.Error(w, "Link expired or invalid.", http.StatusForbidden)
+        return
+    }
+    id := values.Get("id")
+    query, err := decodeQuery(values)
+    if err != nil {
+        http.Error(w, "Format unaccepted.", http.StatusBadRequest)
+        return
+    }
+
+    buckets, unit, err := trend(id, query)
+    if err == errTooManyBuckets {
+        http.Error(w, "Period too long.", http.StatusBadRequest)
+        return
+    } else if err != nil {
+        log.Println(fmt.Sprintf(`Charting for %s failed : "%s".`, id, err))
+        http.Error(w, "Internal error.", http.StatusInternalServerError)
+        return
+    }
+    chart, err := renderTrend(query, buckets, unit)
+    if err != nil {
+        log.Println(fmt.Sprintf(`Rendering chart for %s failed : "%s".`, id, err))
+        http.Error(w, "Internal error.", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "image/png")
+    w.Header().Set("Cache-Control", "public, max-age=86400")
+    w.Write(chart)
+}
+
+func replyTrendMessage(event *linebot.Event, response string, chartUri string) {
+    var err error
+    if _, err = bot.ReplyMessage(event.ReplyToken, linebot.NewTextMessage(response), linebot.NewImageMessage(chartUri, chartUri)).Do(); err != nil {
+        log.Println(err)
+    }
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+)
+
+// Modes Of A Triggered Push
+const (
+    triggerInspect = "inspect"
+    triggerSummary = "summary"
+    triggerText    = "text"
+)
+
+// Maximum Targets In One Triggered Push
+const maxTriggerTargets = 500
+
+type triggerRequest struct {
+    Targets   []string `json:"targets"`
+    Defects   []string `json:"defects"`
+    Period    string   `json:"period"`
+    Mode      string   `json:"mode"`
+    Text      string   `json:"text"`
+    Header    string   `json:"header"`
+    SkipEmpty bool     `json:"skip_empty"`
+}
+
+type triggerResult struct {
+    ID      string `json:"id"`
+    Sent    bool   `json:"sent"`
+    Skipped bool   `json:"skipped,omitempty"`
+    Error   string `json:"error,omitempty"`
+    Reason  string `json:"reason,omitempty"`
+}
+
+func triggerPostHandler(w http.ResponseWriter, r *http.Request) {
+    key, ok := requestKey(r)
+    if !ok || !key.allows(scopeTrigger) {
+        writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+        return
+    }
+
+    var request triggerRequest
+    if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format unaccepted"})
+        return
+    }
+    if request.Mode == "" {
+        request.Mode = triggerInspect
+    }
+    query, err := triggerQuery(request)
+    if err != nil {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+        return
+    }
+
+    results := []triggerResult{}
+    for _, id := range request.Targets {
+        result := triggerResult{ID: id}
+        if !validTarget(id) {
+            result.Error = "id unaccepted"
+        } else if !key.canPush(id) {
+            result.Error = "forbidden"
+        } else if quarantined, err := isQuarantined(id); err != nil {
+            log.Println(fmt.Sprintf(`Checking quarantine of %s failed : "%s".`, id, err))
+            result.Error = "internal error"
+        } else if quarantined {
+            result.Error = "quarantined"
+        } else {
+            result = triggerPush(id, request, query)
+        }
+        results = append(results, result)
+    }
+
+    log.Println(fmt.Sprintf("Key %s triggered %s to %d targets.", key.name, request.Mode, len(request.Targets)))
+    writeJSON(w, http.StatusOK, map[string][]triggerResult{"results": results})
+}
+
+func triggerQuery(request triggerRequest) (DefectQuery, error) {
+    if len(request.Targets) == 0 || len(request.Targets) > maxTriggerTargets {
+        return DefectQuery{}, fmt.Errorf("targets must have 1 to %d ids", maxTriggerTargets)
+    }
+    switch request.Mode {
+    case triggerInspect, triggerSummary:
+    case triggerText:
+        if request.Text == "" {
+            return DefectQuery{}, fmt.Errorf("text is required in text mode")
+        }
+        return DefectQuery{}, nil
+    default:
+        return DefectQuery{}, fmt.Errorf("unknown mode %s", request.Mode)
+    }
+
+    // Same defects and period as the chat commands, subscriptions of each target if defects is empty
+    arguments := append([]string{}, request.Defects...)
+    if request.Period != "" {
+        arguments = append(arguments, request.Period)
+    }
+    query, err := queryArguments(arguments)
+    if err != nil || query.page != 1 {
+        return query, fmt.Errorf("defects or period unaccepted")
+    }
+    return query, nil
+}
+
+func triggerPush(id string, request triggerRequest, query DefectQuery) triggerResult {
+    result := triggerResult{ID: id}
+    report := Report{title: "缺陷詳情", header: request.Header, query: query}
+    switch request.Mode {
+    case triggerText:
+        report.title, report.text = "通知", request.Text
+    case triggerSummary:
+        report.title, report.summary = "缺陷彙整", true
+    }
+
+    sent, err := notify(id, report, request.SkipEmpty)
+    if err != nil {
+        result.Error = err.Error()
+        result.Reason, _ = classifyPushError(err)
+        return result
+    }
+    result.Sent, result.Skipped = sent, !sent
+    return result
+}
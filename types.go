@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 type Defect struct {
 	markid string
 	num    int
@@ -20,3 +22,25 @@ type Roadmark struct {
 	markid string
 	name   string
 }
+
+type DefectQuery struct {
+	markids []string
+	window  time.Duration
+	from    time.Time
+	to      time.Time
+	page    int
+	cursor  string
+	after   string
+	until   string
+	area    *Geofence
+	keyword string
+}
+
+type Geofence struct {
+	kind     string
+	name     string
+	lat      float64
+	lng      float64
+	radius   float64
+	polygons [][][][2]float64
+}
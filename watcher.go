@@ -0,0 +1,176 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "log"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Maximum New Defects Fetched In One Poll
+const watchFetchLimit = 1000
+
+func watcherEnabled() bool {
+    interval, err := time.ParseDuration(os.Getenv("WatchInterval"))
+    return err == nil && interval > 0
+}
+
+func watchJob() {
+    if !watcherEnabled() {
+        log.Println("Watcher disabled.")
+        return
+    }
+    interval, _ := time.ParseDuration(os.Getenv("WatchInterval"))
+    batch, err := time.ParseDuration(os.Getenv("WatchBatch"))
+    if err != nil || batch < 0 {
+        batch = 0
+    }
+
+    seq, err := retriveWatcherSeq()
+    for err != nil { // Keep trying, the watcher can't start without knowing where it stopped
+        log.Println(fmt.Sprintf(`Watcher failed to load its seq_id : "%s".`, err))
+        time.Sleep(interval)
+        seq, err = retriveWatcherSeq()
+    }
+    log.Println(fmt.Sprintf("Watcher started from seq_id %s, polling every %s.", seq, interval))
+
+    var pending []DefectDetail
+    var batchStart time.Time
+    var batchSeq string
+    notifiedSeq := seq
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for range ticker.C {
+        defectDetails, err := retriveNewDefects(seq)
+        if err != nil {
+            log.Println(fmt.Sprintf(`Watcher failed to poll : "%s".`, err))
+            continue
+        }
+        if len(defectDetails) > 0 {
+            if len(pending) == 0 {
+                batchStart, batchSeq = time.Now(), seq
+            }
+            pending = append(pending, defectDetails...)
+            seq = defectDetails[len(defectDetails)-1].seq_id
+        }
+
+        // Wait for the burst to settle before pushing
+        if len(pending) == 0 || time.Since(batchStart) < batch {
+            continue
+        }
+        // Webhooks are told once, they have their own queue and retries
+        if notifiedSeq != seq {
+            if err = notifyNewDefects(notifiedSeq, seq); err != nil {
+                log.Println(fmt.Sprintf(`Watcher failed to notify webhooks : "%s".`, err))
+            }
+            notifiedSeq = seq
+        }
+        // Chats are alerted again next tick until all of them got it, watermarks skip those who did
+        if err = alertDefects(pending, batchSeq, seq); err != nil {
+            log.Println(fmt.Sprintf(`Watcher failed to alert, retry next time : "%s".`, err))
+            continue
+        }
+        if err = updateWatcherSeq(seq); err != nil {
+            log.Println(fmt.Sprintf(`Watcher failed to save its seq_id : "%s".`, err))
+        }
+        pending = nil
+    }
+}
+
+func retriveNewDefects(seq string) ([]DefectDetail, error) {
+    var defectDetails []DefectDetail
+    err := source.Defects(DefectQuery{markids: []string{"all"}, after: seq}, orderSeq, watchFetchLimit, 0, func(defectDetail DefectDetail) error {
+        defectDetails = append(defectDetails, defectDetail)
+        return nil
+    })
+
+    return defectDetails, err
+}
+
+func alertDefects(defectDetails []DefectDetail, after string, latest string) error {
+    markids := []string{}
+    for _, defectDetail := range defectDetails {
+        if !contains(markids, defectDetail.markid) {
+            markids = append(markids, defectDetail.markid)
+        }
+    }
+
+    args := make([]interface{}, len(markids))
+    for i, markid := range markids {
+        args[i] = markid
+    }
+    rows, err := db.Query(`select id from subscriber where (subscribe = 'all' or subscribe in (?`+strings.Repeat(",?", len(markids)-1)+`)) and id not in (select id from delivery where quarantined = 1) group by id`, args...)
+    if err != nil {
+        return err
+    }
+    var idList []string
+    for rows.Next() {
+        var id string
+        if err = rows.Scan(&id); err != nil {
+            rows.Close()
+            return err
+        }
+        idList = append(idList, id)
+    }
+    rows.Close()
+
+    log.Println(fmt.Sprintf("Watcher found %d new defects of %s, alerting %d chats.", len(defectDetails), strings.Join(markids, " "), len(idList)))
+    failures := 0
+    for _, id := range idList {
+        if err := alertChat(id, after, latest); err != nil {
+            log.Println(fmt.Sprintf(`Alerting %s failed : "%s".`, id, err))
+            failures += 1
+        }
+    }
+    if failures > 0 {
+        return fmt.Errorf("alerting %d of %d chats failed", failures, len(idList))
+    }
+    return nil
+}
+
+func alertChat(id string, after string, latest string) error {
+    // Only the burst, minus what the chat already received
+    watermark, err := retriveWatermark(id)
+    if err != nil {
+        return err
+    }
+    query := DefectQuery{markids: []string{}, page: 1, after: laterSeq(after, watermark), until: latest}
+    sent, err := notify(id, Report{title: "即時缺陷通報", query: query}, true)
+    if sent && err == nil {
+        return updateWatermark(id, latest)
+    }
+    return err
+}
+
+func laterSeq(a string, b string) string {
+    x, _ := strconv.ParseInt(a, 10, 64)
+    y, err := strconv.ParseInt(b, 10, 64)
+    if err == nil && y > x {
+        return b
+    }
+    return a
+}
+
+func retriveWatcherSeq() (string, error) {
+    var seq sql.NullString
+    err := db.QueryRow("select seq_id from watcher where name = 'recv'").Scan(&seq)
+    if err == sql.ErrNoRows { // Start from the latest defect instead of the whole history
+        latest, err := source.LatestSeq(DefectQuery{markids: []string{"all"}})
+        if err != nil {
+            return "", err
+        }
+        if latest == "" {
+            latest = "0"
+        }
+        return latest, updateWatcherSeq(latest)
+    }
+    return seq.String, err
+}
+
+func updateWatcherSeq(seq string) error {
+    _, err := db.Exec("insert into watcher (name, seq_id) values ('recv', ?) on conflict(name) do update set seq_id = excluded.seq_id", seq)
+    return err
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Events Sent To Webhooks, defect.new Comes From The Watcher So Only While WatchInterval Is Set
+const (
+    eventDefectNew = "defect.new"
+    eventDigest    = "digest"
+)
+
+// Retries Of A Webhook Delivery, Waiting Twice As Long Each Time
+const (
+    webhookAttempts = 5
+    webhookTimeout  = 10 * time.Second
+)
+
+// Wait Before The First Retry Of A Webhook Delivery
+var webhookBackoff = 2 * time.Second
+
+// Maximum Defects Listed In A Digest Event
+const webhookDigestLimit = 500
+
+// Events Waiting For Each Webhook, Later Ones Are Dropped While It's Full
+const webhookQueueSize = 2000
+
+// How Long Delivery Records Are Kept
+const webhookDeliveryRetention = 30 * 24 * time.Hour
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// Declare Global Queues Of Webhooks, Each Delivered In Order By Its Own Worker
+var webhookQueues = map[int]chan webhookEvent{}
+var webhookQueuesLock sync.Mutex
+
+type webhookEvent struct {
+    webhook Webhook
+    event   string
+    payload map[string]interface{}
+}
+
+type Webhook struct {
+    id      int
+    url     string
+    secret  string
+    markids []string
+}
+
+func (webhook Webhook) accepts(markid string) bool {
+    return contains(webhook.markids, "all") || contains(webhook.markids, markid)
+}
+
+func retriveWebhooks() ([]Webhook, error) {
+    rows, err := db.Query("select id, url, secret, markids from webhook where disabled = 0 order by id")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var webhooks []Webhook
+    for rows.Next() {
+        var webhook Webhook
+        var markids string
+        if err = rows.Scan(&webhook.id, &webhook.url, &webhook.secret, &markids); err != nil {
+            return nil, err
+        }
+        webhook.markids = strings.Split(markids, ",")
+        webhooks = append(webhooks, webhook)
+    }
+    return webhooks, rows.Err()
+}
+
+func notifyNewDefects(after string, latest string) error {
+    webhooks, err := retriveWebhooks()
+    if err != nil || len(webhooks) == 0 {
+        return err
+    }
+
+    defectDetails, err := retriveDefectRows(DefectQuery{markids: []string{"all"}, after: after, until: latest}, watchFetchLimit)
+    if err != nil {
+        return err
+    }
+    for _, defectDetail := range defectDetails {
+        payload := map[string]interface{}{"defect": formatAPIDefect(defectDetail)}
+        for _, webhook := range webhooks {
+            if webhook.accepts(defectDetail.markid) {
+                enqueueWebhook(webhook, eventDefectNew, payload)
+            }
+        }
+    }
+    return nil
+}
+
+func notifyDigest() error {
+    webhooks, err := retriveWebhooks()
+    if err != nil {
+        return err
+    }
+
+    for _, webhook := range webhooks {
+        query := DefectQuery{markids: webhook.markids, window: defaultWindow, page: 1}
+        defectDetails, err := retriveDefectRows(query, webhookDigestLimit)
+        if err != nil {
+            return err
+        }
+        defects := []apiDefect{}
+        for _, defectDetail := range defectDetails {
+            defects = append(defects, formatAPIDefect(defectDetail))
+        }
+        defectNums, err := retriveDefectNum("", query)
+        if err != nil {
+            return err
+        }
+        counts := []apiDefectNum{}
+        total := 0
+        for _, defect := range defectNums {
+            total += defect.num
+            counts = append(counts, apiDefectNum{MarkID: defect.markid, Name: defectName(defect.markid), Count: defect.num})
+        }
+        if total == 0 && os.Getenv("OnlyPushingWhenData") == "true" {
+            continue
+        }
+        enqueueWebhook(webhook, eventDigest, map[string]interface{}{"period": formatAPIPeriod(query), "total": total, "counts": counts, "defects": defects})
+    }
+    return nil
+}
+
+func retriveDefectRows(query DefectQuery, limit int) ([]DefectDetail, error) {
+    var defectDetails []DefectDetail
+    err := source.Defects(query, orderSeq, limit, 0, func(defectDetail DefectDetail) error {
+        defectDetails = append(defectDetails, defectDetail)
+        return nil
+    })
+    return defectDetails, err
+}
+
+func enqueueWebhook(webhook Webhook, event string, payload map[string]interface{}) {
+    // Held while sending too, so the queue can't be closed in between
+    webhookQueuesLock.Lock()
+    defer webhookQueuesLock.Unlock()
+    queue, ok := webhookQueues[webhook.id]
+    if !ok {
+        if disabled, err := webhookDisabled(webhook.id); err == nil && disabled { // Removed after it was listed
+            return
+        }
+        queue = make(chan webhookEvent, webhookQueueSize)
+        webhookQueues[webhook.id] = queue
+        go func() {
+            for queued := range queue {
+                // Whatever is still queued when the webhook is removed is dropped
+                if disabled, err := webhookDisabled(queued.webhook.id); err == nil && disabled {
+                    continue
+                }
+                deliverWebhook(queued.webhook, queued.event, queued.payload)
+            }
+        }()
+    }
+
+    select {
+    case queue <- webhookEvent{webhook, event, payload}:
+    default: // A slow receiver shouldn't hold up the watcher or grow without limit
+        log.Println(fmt.Sprintf("Webhook %d dropped %s, its queue is full.", webhook.id, event))
+    }
+}
+
+func closeWebhookQueue(id int) {
+    webhookQueuesLock.Lock()
+    defer webhookQueuesLock.Unlock()
+    if queue, ok := webhookQueues[id]; ok {
+        close(queue)
+        delete(webhookQueues, id)
+    }
+}
+
+func webhookDisabled(id int) (bool, error) {
+    var disabled bool
+    err := db.QueryRow("select disabled from webhook where id = ?", id).Scan(&disabled)
+    if err == sql.ErrNoRows {
+        return true, nil
+    }
+    return disabled, err
+}
+
+func deliverWebhook(webhook Webhook, event string, payload map[string]interface{}) {
+    buffer := make([]byte, 12)
+    rand.Read(buffer)
+    deliveryID := hex.EncodeToString(buffer)
+
+    // Payload is shared by webhooks of the same event, so copy before adding fields
+    message := map[string]interface{}{"event": event, "delivery_id": deliveryID, "sent_at": time.Now().In(remoteZone).Format(time.RFC3339)}
+    for key, value := range payload {
+        message[key] = value
+    }
+    body, _ := json.Marshal(message)
+    mac := hmac.New(sha256.New, []byte(webhook.secret))
+    mac.Write(body)
+    signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+    var status int
+    var err error
+    attempts := 0
+    for wait := webhookBackoff; attempts < webhookAttempts; wait *= 2 {
+        attempts += 1
+        if status, err = postWebhook(webhook.url, event, deliveryID, signature, body); err == nil {
+            break
+        }
+        if status >= 400 && status < 500 && status != http.StatusTooManyRequests { // Retrying won't help
+            break
+        }
+        if attempts < webhookAttempts {
+            time.Sleep(wait)
+        }
+    }
+
+    var errorText interface{}
+    if err != nil {
+        errorText = err.Error()
+        log.Println(fmt.Sprintf(`Webhook %d failed delivering %s after %d attempts : "%s".`, webhook.id, event, attempts, err))
+    }
+    _, dbErr := db.Exec("insert into webhook_delivery (webhook_id, delivery_id, event, status, attempts, error, created_at) values (?, ?, ?, ?, ?, ?, datetime('now', 'localtime'))", webhook.id, deliveryID, event, status, attempts, errorText)
+    if dbErr != nil {
+        log.Println(fmt.Sprintf(`Recording delivery %s of webhook %d failed : "%s".`, deliveryID, webhook.id, dbErr))
+    }
+}
+
+func pruneWebhookDeliveries() {
+    cutoff := time.Now().Add(-webhookDeliveryRetention).Format("2006-01-02 15:04:05")
+    result, err := db.Exec("delete from webhook_delivery where created_at < ?", cutoff)
+    if err != nil {
+        log.Println(fmt.Sprintf(`Pruning webhook deliveries failed : "%s".`, err))
+        return
+    }
+    if pruned, _ := result.RowsAffected(); pruned > 0 {
+        log.Println(fmt.Sprintf("Pruned %d webhook deliveries.", pruned))
+    }
+}
+
+func postWebhook(url string, event string, deliveryID string, signature string, body []byte) (int, error) {
+    request, err := http.NewRequest("POST", url, bytes.NewReader(body))
+    if err != nil {
+        return 0, err
+    }
+    request.Header.Set("Content-Type", "application/json")
+    request.Header.Set("X-Defect-Event", event)
+    request.Header.Set("X-Defect-Delivery", deliveryID)
+    request.Header.Set("X-Defect-Signature", signature)
+
+    response, err := webhookClient.Do(request)
+    if err != nil {
+        return 0, err
+    }
+    defer response.Body.Close()
+    io.Copy(ioutil.Discard, response.Body)
+    if response.StatusCode < 200 || response.StatusCode >= 300 {
+        return response.StatusCode, fmt.Errorf("status %d", response.StatusCode)
+    }
+    return response.StatusCode, nil
+}
+
+func validWebhook(url string, secret string, markids []string) error {
+    if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+        return fmt.Errorf("invalid url %s", url)
+    }
+    if secret == "" {
+        return fmt.Errorf("secret is required")
+    }
+    for _, markid := range markids {
+        if !matchString(`^(D\d{2}|all)$`, markid) {
+            return fmt.Errorf("invalid markid %s", markid)
+        }
+    }
+    return nil
+}
+
+func createWebhook(url string, secret string, markids []string) (int, error) {
+    if err := validWebhook(url, secret, markids); err != nil {
+        return 0, err
+    }
+    if len(markids) == 0 {
+        markids = []string{"all"}
+    }
+    result, err := db.Exec("insert into webhook (url, secret, markids, created_at) values (?, ?, ?, datetime('now', 'localtime'))", url, secret, strings.Join(markids, ","))
+    if err != nil {
+        return 0, err
+    }
+    id, _ := result.LastInsertId()
+    return int(id), nil
+}
+
+func removeWebhook(id int) (bool, error) {
+    result, err := db.Exec("update webhook set disabled = 1 where id = ? and disabled = 0", id)
+    if err != nil {
+        return false, err
+    }
+    removed, _ := result.RowsAffected()
+    closeWebhookQueue(id)
+    return removed == 1, nil
+}
+
+func retriveWebhookList() ([]map[string]interface{}, error) {
+    rows, err := db.Query("select id, url, markids, created_at from webhook where disabled = 0 order by id")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    webhooks := []map[string]interface{}{}
+    for rows.Next() {
+        var id int
+        var url, markids, createdAt string
+        if err = rows.Scan(&id, &url, &markids, &createdAt); err != nil {
+            return nil, err
+        }
+        webhooks = append(webhooks, map[string]interface{}{"id": id, "url": url, "defects": strings.Split(markids, ","), "created_at": createdAt})
+    }
+    return webhooks, rows.Err()
+}
+
+func retriveWebhookDeliveries(id int, limit int) ([]map[string]interface{}, error) {
+    rows, err := db.Query("select delivery_id, event, status, attempts, coalesce(error, ''), created_at from webhook_delivery where webhook_id = ? order by id desc limit ?", id, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    deliveries := []map[string]interface{}{}
+    for rows.Next() {
+        var status, attempts int
+        var deliveryID, event, errorText, createdAt string
+        if err = rows.Scan(&deliveryID, &event, &status, &attempts, &errorText, &createdAt); err != nil {
+            return nil, err
+        }
+        deliveries = append(deliveries, map[string]interface{}{"delivery_id": deliveryID, "event": event, "status": status, "attempts": attempts, "error": errorText, "created_at": createdAt})
+    }
+    return deliveries, rows.Err()
+}
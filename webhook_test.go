@@ -0,0 +1,192 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/hex"
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "sync"
+    "testing"
+    "time"
+)
+
+func localDatabase(t *testing.T) {
+    local, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "data.db"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err = migrateLocalDatabase(local); err != nil {
+        t.Fatal(err)
+    }
+    previous := db
+    db = local
+    t.Cleanup(func() {
+        db = previous
+        local.Close()
+    })
+}
+
+// Receiver Answering With statuses In Turn, The Last One Repeated
+type webhookReceiver struct {
+    lock     sync.Mutex
+    statuses []int
+    requests []*http.Request
+    bodies   [][]byte
+}
+
+func (receiver *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    body, _ := ioutil.ReadAll(r.Body)
+    receiver.lock.Lock()
+    defer receiver.lock.Unlock()
+    status := receiver.statuses[0]
+    if len(receiver.statuses) > 1 {
+        receiver.statuses = receiver.statuses[1:]
+    }
+    receiver.requests = append(receiver.requests, r)
+    receiver.bodies = append(receiver.bodies, body)
+    w.WriteHeader(status)
+}
+
+func (receiver *webhookReceiver) received() int {
+    receiver.lock.Lock()
+    defer receiver.lock.Unlock()
+    return len(receiver.requests)
+}
+
+func TestDeliverWebhook(t *testing.T) {
+    localDatabase(t)
+    webhookBackoff = time.Millisecond
+    defer func() { webhookBackoff = 2 * time.Second }()
+
+    tests := []struct {
+        name     string
+        statuses []int
+        attempts int
+        status   int
+        failed   bool
+    }{
+        {"delivered", []int{200}, 1, 200, false},
+        {"retried until delivered", []int{500, 502, 204}, 3, 204, false},
+        {"rate limited then delivered", []int{429, 200}, 2, 200, false},
+        {"rejected without retry", []int{400}, 1, 400, true},
+        {"gone without retry", []int{410}, 1, 410, true},
+        {"given up", []int{503}, webhookAttempts, 503, true},
+    }
+
+    for i, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            receiver := &webhookReceiver{statuses: test.statuses}
+            server := httptest.NewServer(receiver)
+            defer server.Close()
+            webhook := Webhook{id: i + 1, url: server.URL, secret: "s3cret", markids: []string{"all"}}
+
+            deliverWebhook(webhook, eventDefectNew, map[string]interface{}{"defect": map[string]string{"seq_id": "42"}})
+
+            if receiver.received() != test.attempts {
+                t.Fatalf("got %d attempts, want %d", receiver.received(), test.attempts)
+            }
+            // Every attempt carries the same signed body
+            for j, request := range receiver.requests {
+                mac := hmac.New(sha256.New, []byte(webhook.secret))
+                mac.Write(receiver.bodies[j])
+                if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); request.Header.Get("X-Defect-Signature") != want {
+                    t.Errorf("attempt %d signature %s, want %s", j+1, request.Header.Get("X-Defect-Signature"), want)
+                }
+                if request.Header.Get("X-Defect-Event") != eventDefectNew || request.Header.Get("X-Defect-Delivery") != receiver.requests[0].Header.Get("X-Defect-Delivery") {
+                    t.Errorf("attempt %d headers %v", j+1, request.Header)
+                }
+            }
+            var message map[string]interface{}
+            if err := json.Unmarshal(receiver.bodies[0], &message); err != nil || message["event"] != eventDefectNew || message["delivery_id"] != receiver.requests[0].Header.Get("X-Defect-Delivery") || message["defect"] == nil {
+                t.Errorf("body %s, %v", receiver.bodies[0], err)
+            }
+
+            var status, attempts int
+            var errorText sql.NullString
+            err := db.QueryRow("select status, attempts, error from webhook_delivery where webhook_id = ?", webhook.id).Scan(&status, &attempts, &errorText)
+            if err != nil || status != test.status || attempts != test.attempts || errorText.Valid != test.failed {
+                t.Errorf("recorded %d, %d, %v, %v, want %d, %d, failed %v", status, attempts, errorText, err, test.status, test.attempts, test.failed)
+            }
+        })
+    }
+}
+
+func TestRemoveWebhookDropsQueue(t *testing.T) {
+    localDatabase(t)
+
+    // The first delivery holds the worker until the webhook is removed
+    release := make(chan struct{})
+    var lock sync.Mutex
+    delivered := 0
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        lock.Lock()
+        delivered += 1
+        first := delivered == 1
+        lock.Unlock()
+        if first {
+            <-release
+        }
+    }))
+    defer server.Close()
+
+    id, err := createWebhook(server.URL, "s3cret", []string{"all"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    webhook := Webhook{id: id, url: server.URL, secret: "s3cret", markids: []string{"all"}}
+    for i := 0; i < 5; i++ {
+        enqueueWebhook(webhook, eventDigest, map[string]interface{}{})
+    }
+    for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+        lock.Lock()
+        started := delivered == 1
+        lock.Unlock()
+        if started {
+            break
+        } else if time.Now().After(deadline) {
+            t.Fatal("first delivery never started")
+        }
+    }
+
+    if removed, err := removeWebhook(id); err != nil || !removed {
+        t.Fatalf("removeWebhook got %v, %v", removed, err)
+    }
+    webhookQueuesLock.Lock()
+    _, queued := webhookQueues[id]
+    webhookQueuesLock.Unlock()
+    if queued {
+        t.Error("queue of the removed webhook is still registered")
+    }
+    close(release)
+
+    // The worker drains what's left without delivering it
+    for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+        var recorded int
+        db.QueryRow("select count(*) from webhook_delivery where webhook_id = ?", id).Scan(&recorded)
+        if recorded == 1 {
+            break
+        } else if time.Now().After(deadline) {
+            t.Fatal("first delivery never recorded")
+        }
+    }
+    time.Sleep(50 * time.Millisecond)
+    lock.Lock()
+    defer lock.Unlock()
+    if delivered != 1 {
+        t.Errorf("delivered %d events after removal, want only the one in flight", delivered-1)
+    }
+
+    // Events for it after removal don't start a new queue
+    enqueueWebhook(webhook, eventDigest, map[string]interface{}{})
+    webhookQueuesLock.Lock()
+    _, queued = webhookQueues[id]
+    webhookQueuesLock.Unlock()
+    if queued {
+        t.Error("removed webhook got a new queue")
+    }
+}